@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"net"
 	"time"
 
@@ -9,12 +10,24 @@ import (
 
 // Dial connects to the SOCKS5 server.
 func Dial(addr string, options ...DialOption) (net.Conn, error) {
+	return DialContext(context.Background(), addr, options...)
+}
+
+// DialContext connects to the SOCKS5 server using the provided context.
+// The context and the timeout option cover both the TCP connect and the method negotiation.
+func DialContext(ctx context.Context, addr string, options ...DialOption) (net.Conn, error) {
 	opts := &DialOptions{}
 	for _, o := range options {
 		o(opts)
 	}
 
-	conn, err := net.DialTimeout("tcp", addr, opts.Timeout)
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -25,13 +38,30 @@ func Dial(addr string, options ...DialOption) (net.Conn, error) {
 	}
 
 	cc := gosocks5.ClientConn(conn, selector)
-	if err := cc.Handleshake(); err != nil {
+	if err := cc.HandshakeContext(ctx); err != nil {
 		conn.Close()
 		return nil, err
 	}
 	return cc, nil
 }
 
+// RequestContext sends req over conn and reads the server's reply.
+// If ctx is done before the reply arrives, the exchange is interrupted
+// by expiring the deadline of conn and ctx.Err() is returned.
+func RequestContext(ctx context.Context, conn net.Conn, req *gosocks5.Request) (*gosocks5.Reply, error) {
+	stop := gosocks5.InterruptOnDone(ctx, conn)
+
+	var reply *gosocks5.Reply
+	err := req.Write(conn)
+	if err == nil {
+		reply, err = gosocks5.ReadReply(conn)
+	}
+	if cerr := stop(); cerr != nil {
+		return nil, cerr
+	}
+	return reply, err
+}
+
 // DialOptions describes the options for Transporter.Dial.
 type DialOptions struct {
 	Selector gosocks5.Selector
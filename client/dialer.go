@@ -0,0 +1,281 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// ContextDialer dials a network address with a context, as net.Dialer does.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dialer connects to addresses through a SOCKS5 server using the CONNECT command.
+// It satisfies proxy.Dialer and proxy.ContextDialer from golang.org/x/net/proxy,
+// and DialContext can be used as http.Transport.DialContext.
+type Dialer struct {
+	// ProxyAddr is the address of the SOCKS5 server.
+	ProxyAddr string
+	// Selector negotiates the method with the server, DefaultSelector if nil.
+	Selector gosocks5.Selector
+	// Timeout limits the whole dial, including the SOCKS5 exchange. Zero means no timeout.
+	Timeout time.Duration
+	// Forward connects to the SOCKS5 server, a zero net.Dialer if nil.
+	Forward ContextDialer
+}
+
+// NewDialer creates a Dialer for the SOCKS5 server at addr.
+func NewDialer(addr string, options ...DialOption) *Dialer {
+	opts := &DialOptions{}
+	for _, o := range options {
+		o(opts)
+	}
+
+	return &Dialer{
+		ProxyAddr: addr,
+		Selector:  opts.Selector,
+		Timeout:   opts.Timeout,
+	}
+}
+
+// Dial connects to addr through the SOCKS5 server.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the SOCKS5 server using the provided context.
+// Only TCP networks are supported.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("unsupported network")}
+	}
+	dst, err := gosocks5.NewAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err := forward.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := d.connect(ctx, conn, dst)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Bind asks the SOCKS5 server to accept a connection from addr on behalf of the client,
+// using the BIND command. addr is the expected peer, the server may use it to filter incoming connections.
+func (d *Dialer) Bind(addr string) (*BindListener, error) {
+	return d.BindContext(context.Background(), addr)
+}
+
+// BindContext is like Bind but uses the provided context for connecting to the
+// server and waiting for its first reply.
+func (d *Dialer) BindContext(ctx context.Context, addr string) (*BindListener, error) {
+	dst, err := gosocks5.NewAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dctx := ctx
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		dctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err := forward.DialContext(dctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := d.Selector
+	if selector == nil {
+		selector = DefaultSelector
+	}
+	cc := gosocks5.ClientConn(conn, selector)
+	if err := cc.HandshakeContext(dctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := RequestContext(dctx, cc, gosocks5.NewRequest(gosocks5.CmdBind, dst))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply.Rep != gosocks5.Succeeded {
+		conn.Close()
+		return nil, fmt.Errorf("socks5: bind %s via %s: reply %d", dst, d.ProxyAddr, reply.Rep)
+	}
+
+	return &BindListener{
+		conn: cc,
+		addr: reply.Addr,
+	}, nil
+}
+
+func (d *Dialer) connect(ctx context.Context, conn net.Conn, dst *gosocks5.Addr) (*Conn, error) {
+	selector := d.Selector
+	if selector == nil {
+		selector = DefaultSelector
+	}
+	cc := gosocks5.ClientConn(conn, selector)
+	if err := cc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	reply, err := RequestContext(ctx, cc, gosocks5.NewRequest(gosocks5.CmdConnect, dst))
+	if err != nil {
+		return nil, err
+	}
+	if reply.Rep != gosocks5.Succeeded {
+		return nil, fmt.Errorf("socks5: connect %s via %s: reply %d", dst, d.ProxyAddr, reply.Rep)
+	}
+
+	return &Conn{
+		Conn:      cc,
+		boundAddr: reply.Addr,
+	}, nil
+}
+
+// Conn is a connection established through a SOCKS5 server.
+type Conn struct {
+	net.Conn
+	boundAddr  *gosocks5.Addr
+	remoteAddr net.Addr
+}
+
+// BoundAddr returns the address the server bound for the connection,
+// BND.ADDR and BND.PORT of its reply.
+func (c *Conn) BoundAddr() *gosocks5.Addr {
+	return c.boundAddr
+}
+
+// NetConn returns the connection to the SOCKS5 server underneath c.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// RemoteAddr returns the address of the peer when the server reported it,
+// otherwise the address of the server.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// BindListener is a listener on the SOCKS5 server created by a BIND request.
+// It accepts exactly one connection, the server only relays the first incoming one.
+type BindListener struct {
+	conn      net.Conn
+	addr      *gosocks5.Addr
+	mu        sync.Mutex
+	accepting bool
+	accepted  bool
+	closed    bool
+}
+
+// Accept waits for the server's second reply, sent once the peer has connected,
+// and returns the connection to the peer.
+func (l *BindListener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept but gives up when ctx is done, closing the listener.
+func (l *BindListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if l.accepting || l.accepted {
+		l.mu.Unlock()
+		return nil, errors.New("socks5: bind listener accepts only one connection")
+	}
+	l.accepting = true
+	l.mu.Unlock()
+
+	stop := gosocks5.InterruptOnDone(ctx, l.conn)
+	reply, err := gosocks5.ReadReply(l.conn)
+	if cerr := stop(); cerr != nil {
+		err = cerr
+	}
+	if err == nil && reply.Rep != gosocks5.Succeeded {
+		err = fmt.Errorf("socks5: bind %s: reply %d", l.addr, reply.Rep)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.accepting = false
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+	if err != nil {
+		l.closed = true
+		l.conn.Close()
+		return nil, err
+	}
+
+	l.accepted = true
+	return &Conn{
+		Conn:       l.conn,
+		boundAddr:  l.addr,
+		remoteAddr: &socksAddr{reply.Addr},
+	}, nil
+}
+
+// Close closes the listener, unblocking a pending Accept.
+// Once a connection has been accepted, closing the listener does not affect it.
+func (l *BindListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed || l.accepted {
+		return nil
+	}
+	l.closed = true
+	return l.conn.Close()
+}
+
+// Addr returns the address the server listens on, as reported in its first reply.
+func (l *BindListener) Addr() net.Addr {
+	return &socksAddr{l.addr}
+}
+
+// socksAddr adapts a TCP address from a server reply to net.Addr.
+type socksAddr struct {
+	*gosocks5.Addr
+}
+
+func (a *socksAddr) Network() string {
+	return "tcp"
+}
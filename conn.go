@@ -1,6 +1,7 @@
 package gosocks5
 
 import (
+	"context"
 	"io"
 	//"log"
 	"net"
@@ -17,10 +18,48 @@ type Selector interface {
 	OnSelected(method uint8, conn net.Conn) (net.Conn, error)
 }
 
+// Identity is what a Selector learned about the peer in OnSelected,
+// such as the name of the authenticated user.
+type Identity struct {
+	// User is the name the peer authenticated with, empty if it did not.
+	User string
+	// Attrs are additional attributes of the peer, such as its groups.
+	Attrs map[string]string
+}
+
+// WithIdentity returns conn carrying id, for a Selector's OnSelected to return.
+// The Conn records the identity, and goes on over conn itself.
+func WithIdentity(conn net.Conn, id *Identity) net.Conn {
+	return &identityConn{Conn: conn, id: id}
+}
+
+type identityConn struct {
+	net.Conn
+	id *Identity
+}
+
+func (c *identityConn) Identity() *Identity {
+	return c.id
+}
+
+type identityKey struct{}
+
+// NewIdentityContext returns a copy of ctx carrying id.
+func NewIdentityContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns the identity carried by ctx, or nil.
+func IdentityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
 type Conn struct {
 	c              net.Conn
 	selector       Selector
 	method         uint8
+	identity       *Identity
 	isClient       bool
 	handshaked     bool
 	handshakeMutex sync.Mutex
@@ -62,6 +101,48 @@ func (conn *Conn) Handleshake() error {
 	return conn.handshakeErr
 }
 
+// HandshakeContext runs the handshake if it has not yet been run, like Handleshake.
+// If ctx is done before the handshake completes, the handshake is interrupted
+// by expiring the deadline of the underlying connection and ctx.Err() is returned.
+func (conn *Conn) HandshakeContext(ctx context.Context) error {
+	stop := InterruptOnDone(ctx, conn.c)
+	err := conn.Handleshake()
+	if cerr := stop(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// InterruptOnDone expires the deadline of c when ctx is done, to interrupt an exchange over c.
+// The returned stop function ends the watch, and returns ctx.Err()
+// after restoring the deadline if c has been interrupted.
+func InterruptOnDone(ctx context.Context, c net.Conn) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+			interrupted <- ctx.Err()
+		case <-done:
+			interrupted <- nil
+		}
+	}()
+
+	return func() error {
+		close(done)
+		if err := <-interrupted; err != nil {
+			c.SetDeadline(time.Time{})
+			return err
+		}
+		return nil
+	}
+}
+
 func (conn *Conn) clientHandshake() error {
 	var methods []uint8
 	var nm int
@@ -96,7 +177,7 @@ func (conn *Conn) clientHandshake() error {
 		if err != nil {
 			return err
 		}
-		conn.c = c
+		conn.setSelected(c)
 	}
 	conn.method = b[1]
 	//log.Println("method:", conn.method)
@@ -124,7 +205,7 @@ func (conn *Conn) serverHandshake() error {
 		if err != nil {
 			return err
 		}
-		conn.c = c
+		conn.setSelected(c)
 	}
 	conn.method = method
 	//log.Println("method:", method)
@@ -132,6 +213,28 @@ func (conn *Conn) serverHandshake() error {
 	return nil
 }
 
+// setSelected goes on over the connection returned by OnSelected,
+// recording the identity it carries.
+func (conn *Conn) setSelected(c net.Conn) {
+	if ic, ok := c.(interface{ Identity() *Identity }); ok {
+		conn.identity = ic.Identity()
+	}
+	if ic, ok := c.(*identityConn); ok {
+		c = ic.Conn
+	}
+	conn.c = c
+}
+
+// Method returns the negotiated method, once the handshake is done.
+func (conn *Conn) Method() uint8 {
+	return conn.method
+}
+
+// Identity returns the identity the selector attached in OnSelected, or nil.
+func (conn *Conn) Identity() *Identity {
+	return conn.identity
+}
+
 func (conn *Conn) Read(b []byte) (n int, err error) {
 	if err = conn.Handleshake(); err != nil {
 		return
@@ -146,6 +249,13 @@ func (conn *Conn) Write(b []byte) (n int, err error) {
 	return conn.c.Write(b)
 }
 
+// NetConn returns the connection the SOCKS5 conversation runs over.
+// After the handshake, this is the connection returned by the selector's OnSelected,
+// which for methods without encapsulation is the underlying connection itself.
+func (conn *Conn) NetConn() net.Conn {
+	return conn.c
+}
+
 func (conn *Conn) Close() error {
 	return conn.c.Close()
 }
@@ -4,8 +4,6 @@ import (
 	"flag"
 	"log"
 
-	"github.com/ginuerzh/gosocks5"
-
 	"github.com/ginuerzh/gosocks5/client"
 )
 
@@ -19,23 +17,11 @@ func init() {
 }
 
 func main() {
-	addr, err := gosocks5.NewAddr(flag.Arg(0))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	conn, err := client.Dial(server)
+	conn, err := client.NewDialer(server).Dial("tcp", flag.Arg(0))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 
-	if err := gosocks5.NewRequest(gosocks5.CmdConnect, addr).Write(conn); err != nil {
-		log.Fatal(err)
-	}
-	reply, err := gosocks5.ReadReply(conn)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("reply:", reply)
+	log.Println("bound:", conn.(*client.Conn).BoundAddr())
 }
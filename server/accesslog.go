@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// AccessLogFields are the fields of an access log record, in order:
+//
+//	session   the session ID
+//	client    the address of the client
+//	method    the negotiated method
+//	user      the user name the client authenticated with
+//	command   the command of the request
+//	addr      the address of the request
+//	ip        the address the request was served with, such as the resolved destination
+//	reply     the reply code sent last
+//	up, down  the bytes relayed from and to the client
+//	duration  how long the session lasted
+//	reason    why the session ended, the error of the handler or "closed"
+var AccessLogFields = []string{
+	"session", "client", "method", "user", "command", "addr", "ip",
+	"reply", "up", "down", "duration", "reason",
+}
+
+// AccessLogMiddleware returns a middleware logging one record per session to logger,
+// or the default slog logger if nil. Where the records go is up to the handler of the logger.
+// The records hold the given fields, all of the AccessLogFields if none.
+func AccessLogMiddleware(logger *slog.Logger, fields ...string) Middleware {
+	if len(fields) == 0 {
+		fields = AccessLogFields
+	}
+	return func(h Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) (err error) {
+			sc := withSession(conn)
+			sess := sc.sess
+
+			rec := &accessRecord{}
+			sess.hooks = append(sess.hooks, &Hooks{
+				OnReply: func(ctx context.Context, rep uint8) {
+					rec.replied, rec.rep = true, rep
+				},
+				OnConnect: func(ctx context.Context, upstream net.Conn) {
+					rec.ip = addrIP(upstream.RemoteAddr())
+				},
+				OnRelayDone: func(ctx context.Context, stats *RelayStats) {
+					rec.up, rec.down = stats.Up, stats.Down
+				},
+			})
+
+			defer func() {
+				l := logger
+				if l == nil {
+					l = slog.Default()
+				}
+				l.LogAttrs(sess.ctx, slog.LevelInfo, "session", rec.attrs(sess, err, fields)...)
+			}()
+			return h.Handle(sc)
+		})
+	}
+}
+
+// accessRecord gathers what the hooks tell about a session.
+type accessRecord struct {
+	replied  bool
+	rep      uint8
+	ip       net.IP
+	up, down int64
+}
+
+func (rec *accessRecord) attrs(sess *Session, err error, fields []string) []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, field := range fields {
+		var v slog.Value
+		switch field {
+		case "session":
+			v = slog.StringValue(sess.ID)
+		case "client":
+			v = slog.StringValue(addrString(sess.RemoteAddr))
+		case "method":
+			v = slog.StringValue(methodName(sess.Method))
+		case "user":
+			v = slog.StringValue(sess.User)
+		case "command":
+			v = slog.StringValue("")
+			if sess.Request != nil {
+				v = slog.StringValue(commandName(sess.Request.Cmd))
+			}
+		case "addr":
+			v = slog.StringValue("")
+			if sess.Request != nil && sess.Request.Addr != nil {
+				v = slog.StringValue(sess.Request.Addr.String())
+			}
+		case "ip":
+			v = slog.StringValue("")
+			if rec.ip != nil {
+				v = slog.StringValue(rec.ip.String())
+			}
+		case "reply":
+			v = slog.StringValue("none")
+			if rec.replied {
+				v = slog.StringValue(replyName(rec.rep))
+			}
+		case "up":
+			v = slog.Int64Value(rec.up)
+		case "down":
+			v = slog.Int64Value(rec.down)
+		case "duration":
+			v = slog.DurationValue(time.Since(sess.Start))
+		case "reason":
+			v = slog.StringValue("closed")
+			if err != nil {
+				v = slog.StringValue(err.Error())
+			}
+		default:
+			continue
+		}
+		attrs = append(attrs, slog.Attr{Key: field, Value: v})
+	}
+	return attrs
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// authGuardSweep is how often expired entries are dropped from an AuthGuard.
+const authGuardSweep = time.Minute
+
+var (
+	// ErrAuthBlocked is the error of an authentication attempt refused by an AuthGuard
+	// without checking the credentials, because the source IP or the user is backing off or locked out.
+	ErrAuthBlocked = errors.New("auth: too many failures, retry later")
+)
+
+// AuthLimits configures an AuthGuard.
+type AuthLimits struct {
+	// Backoff is how long a source IP or a user must wait after a failure
+	// before trying again. It doubles with each consecutive failure. Zero disables backoff.
+	Backoff time.Duration
+	// MaxBackoff caps the backoff, one minute if zero.
+	MaxBackoff time.Duration
+	// MaxFailures is the number of consecutive failures locking a source IP or a user out.
+	// Zero disables lockouts.
+	MaxFailures int
+	// Lockout is how long a lockout lasts, fifteen minutes if zero.
+	Lockout time.Duration
+}
+
+// Lockout describes a source IP or a user being locked out.
+type Lockout struct {
+	// IP is the source IP locked out, empty if a user is.
+	IP string
+	// User is the user locked out, empty if a source IP is.
+	User string
+	// Failures is the number of consecutive failures which caused it.
+	Failures int
+	// Until is when the lockout ends.
+	Until time.Time
+}
+
+// AuthGuard protects authentication from brute force,
+// by tracking the failures per source IP and per username.
+// Failures make the source IP and the user back off exponentially,
+// and too many of them in a row lock them out for a while.
+// Attempts during a backoff or a lockout fail with ErrAuthBlocked,
+// and a blocked source IP is offered no method which authenticates.
+// A successful authentication resets the source IP and the user.
+type AuthGuard struct {
+	mu        sync.Mutex
+	limits    AuthLimits
+	ips       map[string]*authFailures
+	users     map[string]*authFailures
+	lastSweep time.Time
+}
+
+// NewAuthGuard creates an authentication guard with the limits.
+func NewAuthGuard(limits AuthLimits) *AuthGuard {
+	return &AuthGuard{
+		limits:    limits,
+		ips:       make(map[string]*authFailures),
+		users:     make(map[string]*authFailures),
+		lastSweep: time.Now(),
+	}
+}
+
+// SetLimits changes the limits.
+func (g *AuthGuard) SetLimits(limits AuthLimits) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.limits = limits
+}
+
+// Limits returns the limits.
+func (g *AuthGuard) Limits() AuthLimits {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.limits
+}
+
+// Reset forgets the failures of the source IP or the user, lifting their lockout.
+func (g *AuthGuard) Reset(ip, user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.ips, ip)
+	delete(g.users, user)
+}
+
+// check returns ErrAuthBlocked if ip or user may not try to authenticate yet.
+// An empty user is not checked.
+func (g *AuthGuard) check(ip, user string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if f := g.ips[ip]; f != nil && now.Before(f.until) {
+		return ErrAuthBlocked
+	}
+	if f := g.users[user]; user != "" && f != nil && now.Before(f.until) {
+		return ErrAuthBlocked
+	}
+	return nil
+}
+
+// fail records a failure of user from ip, and returns the lockouts it causes.
+// The failure of an unknown user, empty, only counts against ip.
+func (g *AuthGuard) fail(ip, user string) []*Lockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(g.lastSweep) > authGuardSweep {
+		g.sweep(now)
+	}
+
+	var lockouts []*Lockout
+	if lockout := g.record(g.ips, ip, now); lockout != nil {
+		lockout.IP = ip
+		lockouts = append(lockouts, lockout)
+	}
+	if user == "" {
+		return lockouts
+	}
+	if lockout := g.record(g.users, user, now); lockout != nil {
+		lockout.User = user
+		lockouts = append(lockouts, lockout)
+	}
+	return lockouts
+}
+
+// succeed resets ip and user after a successful authentication.
+func (g *AuthGuard) succeed(ip, user string) {
+	g.Reset(ip, user)
+}
+
+func (g *AuthGuard) record(failures map[string]*authFailures, key string, now time.Time) *Lockout {
+	f := failures[key]
+	if f == nil {
+		f = &authFailures{}
+		failures[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if g.limits.MaxFailures > 0 && f.count >= g.limits.MaxFailures {
+		lockout := g.limits.Lockout
+		if lockout <= 0 {
+			lockout = 15 * time.Minute
+		}
+		f.until = now.Add(lockout)
+		return &Lockout{Failures: f.count, Until: f.until}
+	}
+	if g.limits.Backoff > 0 {
+		max := g.limits.MaxBackoff
+		if max <= 0 {
+			max = time.Minute
+		}
+		backoff := g.limits.Backoff
+		for i := 1; i < f.count && backoff < max; i++ {
+			backoff *= 2
+		}
+		if backoff > max {
+			backoff = max
+		}
+		f.until = now.Add(backoff)
+	}
+	return nil
+}
+
+// sweep drops the entries which are neither blocked nor recent.
+// An entry is recent while a new failure would still count as consecutive.
+func (g *AuthGuard) sweep(now time.Time) {
+	g.lastSweep = now
+	keep := g.limits.Lockout
+	if keep < 15*time.Minute {
+		keep = 15 * time.Minute
+	}
+	for _, failures := range []map[string]*authFailures{g.ips, g.users} {
+		for key, f := range failures {
+			if now.After(f.until) && now.Sub(f.last) > keep {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+// authFailures are the consecutive failures of a source IP or a user.
+type authFailures struct {
+	count int
+	last  time.Time // when the last failure happened
+	until time.Time // when the backoff or the lockout ends
+}
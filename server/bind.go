@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+const (
+	defaultBindTimeout = 2 * time.Minute
+)
+
+var (
+	errBindClosed = errors.New("bind: client closed the connection")
+)
+
+// BindOptions is options for BIND requests.
+type BindOptions struct {
+	// ListenIP is the address the server listens on for the incoming connection.
+	// If nil, the local address of the client connection is used.
+	ListenIP net.IP
+	// AdvertiseHost is the host reported to the client in the first reply,
+	// for example the public address of a server behind NAT.
+	// If empty, the listening address is reported, or the local address
+	// of the client connection if ListenIP is the unspecified address.
+	AdvertiseHost string
+	// MinPort and MaxPort restrict the listening port to a range.
+	// If both are zero, the system picks the port.
+	MinPort, MaxPort int
+	// AcceptTimeout limits how long the server waits for the incoming connection,
+	// two minutes if zero.
+	AcceptTimeout time.Duration
+	// AnyPeer accepts the incoming connection from any address.
+	// By default the peer must match DST.ADDR of the request,
+	// unless that is the unspecified address.
+	AnyPeer bool
+}
+
+func (h *serverHandler) handleBind(ctx context.Context, conn net.Conn, req *gosocks5.Request) error {
+	opts := h.bind
+	sess := sessionOf(ctx)
+
+	ip := opts.ListenIP
+	if ip == nil {
+		ip = addrIP(conn.LocalAddr())
+	}
+	ln, err := listenBind(ip, opts.MinPort, opts.MaxPort)
+	if err != nil {
+		return sess.replyError(conn, err)
+	}
+
+	// The unspecified address is no use to the client,
+	// which reaches the server at the local address of its connection.
+	host := opts.AdvertiseHost
+	if local := addrIP(conn.LocalAddr()); host == "" && ip.IsUnspecified() && local != nil {
+		host = local.String()
+	}
+	socksAddr := toSocksAddr(ln.Addr())
+	if host != "" {
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		if addr, err := gosocks5.NewAddr(net.JoinHostPort(host, port)); err == nil {
+			socksAddr = addr
+		}
+	}
+	if err := sess.reply(conn, gosocks5.Succeeded, socksAddr); err != nil {
+		ln.Close()
+		return err
+	}
+
+	peers, err := h.bindPeers(ctx, req.Addr)
+	if err != nil {
+		ln.Close()
+		return sess.replyError(conn, err)
+	}
+
+	timeout := opts.AcceptTimeout
+	if timeout <= 0 {
+		timeout = defaultBindTimeout
+	}
+	pconn, err := acceptBind(conn, ln, peers, timeout)
+	ln.Close()
+	if err != nil {
+		if err == errBindClosed {
+			return err
+		}
+		return sess.replyError(conn, err)
+	}
+	defer pconn.Close()
+
+	if err := sess.reply(conn, gosocks5.Succeeded, toSocksAddr(pconn.RemoteAddr())); err != nil {
+		return err
+	}
+	sess.onConnect(pconn)
+
+	stats := transport(conn, pconn, sess)
+	sess.onRelayDone(stats)
+	return stats.Err
+}
+
+// bindPeers returns the addresses an incoming connection is accepted from, nil for any.
+func (h *serverHandler) bindPeers(ctx context.Context, addr *gosocks5.Addr) ([]net.IP, error) {
+	if h.bind.AnyPeer || addr == nil || addr.Host == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(addr.Host); ip != nil {
+		if ip.IsUnspecified() {
+			return nil, nil
+		}
+		return []net.IP{ip}, nil
+	}
+
+	return h.lookup(ctx, addr.Host)
+}
+
+// listenBind listens on ip, on a port from the range [min, max] if one is given.
+func listenBind(ip net.IP, min, max int) (*net.TCPListener, error) {
+	if min <= 0 && max <= 0 {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	}
+	if min <= 0 {
+		min = 1
+	}
+	if max <= 0 || max > 65535 {
+		max = 65535
+	}
+	if min > max {
+		return nil, errors.New("bind: invalid port range")
+	}
+
+	var err error
+	n := max - min + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		var ln *net.TCPListener
+		ln, err = net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: min + (start+i)%n})
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, err
+}
+
+// acceptBind waits for a connection from one of peers on ln.
+// Connections from other addresses are dropped. It gives up when the timeout
+// expires or the client closes its connection.
+func acceptBind(conn net.Conn, ln *net.TCPListener, peers []net.IP, timeout time.Duration) (net.Conn, error) {
+	ln.SetDeadline(time.Now().Add(timeout))
+
+	// The client has nothing to send before the second reply,
+	// so a read returning means it has gone away.
+	closed := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		b := make([]byte, 1)
+		if _, err := conn.Read(b); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return
+			}
+		}
+		close(closed)
+		ln.Close()
+	}()
+	defer func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-watched
+		conn.SetReadDeadline(time.Time{})
+	}()
+
+	for {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			select {
+			case <-closed:
+				return nil, errBindClosed
+			default:
+			}
+			return nil, err
+		}
+		if peers == nil || matchPeer(peers, addrIP(c.RemoteAddr())) {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+func matchPeer(peers []net.IP, ip net.IP) bool {
+	for _, peer := range peers {
+		if peer.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
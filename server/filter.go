@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// IPFilter decides which source addresses may connect, from lists of allowed and denied networks.
+// The most specific network containing an address decides, so that a network may be
+// denied within an allowed one and the other way round. An address in no network is allowed
+// if the allow list is empty, and denied otherwise.
+// The lists may be reloaded at any time, connections being checked against either the old or the new ones.
+type IPFilter struct {
+	v atomic.Value // *ipFilterTables
+}
+
+type ipFilterTables struct {
+	v4, v6   *prefixTrie
+	defaults bool // whether an address in no network is allowed
+}
+
+// NewIPFilter creates a filter with the allowed and denied networks.
+func NewIPFilter(allow, deny []*net.IPNet) *IPFilter {
+	f := &IPFilter{}
+	f.Load(allow, deny)
+	return f
+}
+
+// Load replaces the allowed and denied networks.
+// A network in both lists is denied.
+func (f *IPFilter) Load(allow, deny []*net.IPNet) {
+	t := &ipFilterTables{
+		v4:       &prefixTrie{},
+		v6:       &prefixTrie{},
+		defaults: len(allow) == 0,
+	}
+	for _, n := range allow {
+		t.insert(n, true)
+	}
+	for _, n := range deny {
+		t.insert(n, false)
+	}
+	f.v.Store(t)
+}
+
+// Allow reports whether ip may connect.
+func (f *IPFilter) Allow(ip net.IP) bool {
+	t, _ := f.v.Load().(*ipFilterTables)
+	if t == nil {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4.lookup(ip4, t.defaults)
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return t.v6.lookup(ip16, t.defaults)
+	}
+	return t.defaults
+}
+
+func (t *ipFilterTables) insert(n *net.IPNet, allow bool) {
+	ones, bits := n.Mask.Size()
+	switch {
+	case bits == 8*net.IPv4len && n.IP.To4() != nil:
+		t.v4.insert(n.IP.To4(), ones, allow)
+	case bits == 8*net.IPv6len:
+		if ip4 := n.IP.To4(); ip4 != nil && ones >= 96 {
+			// An IPv4 network written as IPv4-mapped IPv6.
+			t.v4.insert(ip4, ones-96, allow)
+			return
+		}
+		t.v6.insert(n.IP.To16(), ones, allow)
+	}
+}
+
+// prefixTrie is a binary trie of network prefixes, one bit per level.
+type prefixTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	set      bool // whether a prefix ends here
+	allow    bool
+}
+
+func (t *prefixTrie) insert(ip net.IP, ones int, allow bool) {
+	n := &t.root
+	for i := 0; i < ones; i++ {
+		b := ipBit(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = &trieNode{}
+		}
+		n = n.children[b]
+	}
+	if n.set && !n.allow {
+		return // deny wins over allow for the same network
+	}
+	n.set, n.allow = true, allow
+}
+
+// lookup returns the decision of the longest prefix containing ip, or defaults.
+func (t *prefixTrie) lookup(ip net.IP, defaults bool) bool {
+	allow := defaults
+	n := &t.root
+	for i := 0; ; i++ {
+		if n.set {
+			allow = n.allow
+		}
+		if i == 8*len(ip) {
+			return allow
+		}
+		n = n.children[ipBit(ip, i)]
+		if n == nil {
+			return allow
+		}
+	}
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
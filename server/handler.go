@@ -1,11 +1,12 @@
 package server
 
 import (
-	"fmt"
-	"io"
+	"context"
+	"errors"
+	"log"
 	"net"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/ginuerzh/gosocks5"
 )
@@ -16,9 +17,7 @@ var (
 )
 
 func init() {
-	DefaultHandler = &serverHandler{
-		selector: DefaultSelector,
-	}
+	DefaultHandler = NewHandler()
 }
 
 // Handler is interface for server handler.
@@ -26,170 +25,529 @@ type Handler interface {
 	Handle(conn net.Conn) error
 }
 
-type serverHandler struct {
-	selector gosocks5.Selector
+// Dialer makes the outbound connections for CONNECT requests.
+// It is satisfied by *net.Dialer, *Egress and *client.Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
-func (h *serverHandler) Handle(conn net.Conn) error {
-	conn = gosocks5.ServerConn(conn, h.selector)
-	req, err := gosocks5.ReadRequest(conn)
-	if err != nil {
-		return err
+// Resolver resolves destination host names. It is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Policy decides whether a request from user at src is allowed.
+// The datagrams of a UDP association are checked too, each as a UDP ASSOCIATE request
+// whose address is the destination of the datagram.
+// Requests which are not allowed are rejected with a NotAllowed reply.
+type Policy func(user string, src net.Addr, req *gosocks5.Request) bool
+
+// HandlerOptions is options for the server handler.
+type HandlerOptions struct {
+	Selector gosocks5.Selector
+	// Router picks the egress of CONNECT requests, overriding Dialer.
+	// UDP associations take the source addresses of the egress of their user and source.
+	Router *Router
+	Bind   *BindOptions
+	// Dialer makes outbound connections when there is no router, DirectEgress if nil.
+	Dialer Dialer
+	// Resolver resolves destination host names before dialing.
+	// If nil, names are passed to the dialer as they are.
+	Resolver Resolver
+	// Policies are checked in order for each request, all of them must allow it.
+	Policies []Policy
+	// Logger receives the handler's messages, such as rejected requests.
+	// If nil, the standard logger is used.
+	Logger *log.Logger
+	// Mux dispatches the requests to command handlers.
+	// The commands it has no handler for go to the built-in ones.
+	Mux *ServeMux
+	// RateLimiter limits the bandwidth of the relayed sessions.
+	RateLimiter *RateLimiter
+	// Scheduler shares the bandwidth among classes of sessions.
+	Scheduler *Scheduler
+	// SessionLimiter limits the sessions per source IP and per user.
+	SessionLimiter *SessionLimiter
+	// AuthGuard protects authentication from brute force. Source IPs are guarded
+	// with any selector, users with selectors which report them through AuthAttempt.
+	// Failures are the ErrAuthFailure errors of the selector.
+	AuthGuard *AuthGuard
+}
+
+// HandlerOption allows a common way to set handler options.
+type HandlerOption func(opts *HandlerOptions)
+
+// SelectorHandlerOption sets the selector used for method negotiation.
+func SelectorHandlerOption(selector gosocks5.Selector) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Selector = selector
+	}
+}
+
+// RouterHandlerOption sets the router which picks the egress for CONNECT requests.
+func RouterHandlerOption(router *Router) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Router = router
+	}
+}
+
+// BindHandlerOption sets the options for BIND requests.
+func BindHandlerOption(bind *BindOptions) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Bind = bind
 	}
+}
 
-	switch req.Cmd {
-	case gosocks5.CmdConnect:
-		return h.handleConnect(conn, req)
+// DialerHandlerOption sets the dialer for outbound connections.
+func DialerHandlerOption(dialer Dialer) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Dialer = dialer
+	}
+}
 
-	case gosocks5.CmdBind:
-		return h.handleBind(conn, req)
+// ResolverHandlerOption sets the resolver for destination host names.
+func ResolverHandlerOption(resolver Resolver) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Resolver = resolver
+	}
+}
 
-	// case gosocks5.CmdUdp:
-	// h.handleUDPRelay(conn, req)
+// PolicyHandlerOption adds policies checked for each request.
+func PolicyHandlerOption(policies ...Policy) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Policies = append(opts.Policies, policies...)
+	}
+}
 
-	default:
-		return fmt.Errorf("%d: unsupported command", gosocks5.CmdUnsupported)
+// LoggerHandlerOption sets the logger of the handler.
+func LoggerHandlerOption(logger *log.Logger) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Logger = logger
 	}
 }
 
-func (h *serverHandler) handleConnect(conn net.Conn, req *gosocks5.Request) error {
-	cc, err := net.Dial("tcp", req.Addr.String())
-	if err != nil {
-		rep := gosocks5.NewReply(gosocks5.HostUnreachable, nil)
-		rep.Write(conn)
-		return err
+// MuxHandlerOption sets the mux dispatching requests to command handlers.
+// The commands it has no handler for go to the built-in ones.
+func MuxHandlerOption(mux *ServeMux) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Mux = mux
 	}
-	defer cc.Close()
+}
 
-	rep := gosocks5.NewReply(gosocks5.Succeeded, nil)
-	if err := rep.Write(conn); err != nil {
-		return err
+// RateLimiterHandlerOption sets the rate limiter of the relayed sessions.
+func RateLimiterHandlerOption(limiter *RateLimiter) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.RateLimiter = limiter
 	}
+}
 
-	return transport(conn, cc)
+// SchedulerHandlerOption sets the scheduler sharing the bandwidth among classes of sessions.
+func SchedulerHandlerOption(scheduler *Scheduler) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.Scheduler = scheduler
+	}
 }
 
-var (
-	trPool = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 1500)
-		},
+// SessionLimiterHandlerOption sets the limiter of the sessions per source IP and per user.
+func SessionLimiterHandlerOption(limiter *SessionLimiter) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.SessionLimiter = limiter
+	}
+}
+
+// AuthGuardHandlerOption sets the guard protecting username/password authentication from brute force.
+func AuthGuardHandlerOption(guard *AuthGuard) HandlerOption {
+	return func(opts *HandlerOptions) {
+		opts.AuthGuard = guard
+	}
+}
+
+// NewHandler creates a server handler.
+func NewHandler(options ...HandlerOption) Handler {
+	opts := &HandlerOptions{}
+	for _, o := range options {
+		o(opts)
+	}
+	if opts.Selector == nil {
+		opts.Selector = DefaultSelector
+	}
+	if opts.Bind == nil {
+		opts.Bind = &BindOptions{}
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = DirectEgress
+	}
+
+	h := &serverHandler{
+		selector: opts.Selector,
+		router:   opts.Router,
+		bind:     opts.Bind,
+		dialer:   opts.Dialer,
+		resolver: opts.Resolver,
+		policies: opts.Policies,
+		logger:   opts.Logger,
+		mux:      opts.Mux,
+		limiter:  opts.RateLimiter,
+		sched:    opts.Scheduler,
+		sessions: opts.SessionLimiter,
+		guard:    opts.AuthGuard,
 	}
+
+	h.builtins = NewServeMux()
+	h.builtins.HandleFunc(gosocks5.CmdConnect, h.handleConnect)
+	h.builtins.HandleFunc(gosocks5.CmdBind, h.handleBind)
+	h.builtins.HandleFunc(gosocks5.CmdUdp, h.handleUDP)
+
+	return h
+}
+
+type serverHandler struct {
+	selector gosocks5.Selector
+	router   *Router
+	bind     *BindOptions
+	dialer   Dialer
+	resolver Resolver
+	policies []Policy
+	logger   *log.Logger
+	mux      *ServeMux // nil for the built-in handlers only
+	builtins *ServeMux
+	limiter  *RateLimiter
+	sched    *Scheduler
+	sessions *SessionLimiter
+	guard    *AuthGuard
+}
+
+var (
+	errNotAllowed = errors.New("request not allowed")
 )
 
-func (h *serverHandler) handleBind(conn net.Conn, req *gosocks5.Request) error {
-	addr := req.Addr.String()
-	bindAddr, _ := net.ResolveTCPAddr("tcp", addr)
-	ln, err := net.ListenTCP("tcp", bindAddr) // strict mode: if the port already in use, it will return error
+// AuthAttempt is implemented by the connection the selector of the handler gets in OnSelected.
+// A selector authenticating users by name calls Attempt with the name the client gives,
+// before checking the credentials, and fails the authentication with the error returned, if any:
+// the AuthGuard of the handler may block the user. The name is the one reported if authentication fails.
+type AuthAttempt interface {
+	Attempt(user string) error
+}
+
+// authConn records who tries to authenticate on a connection.
+// The handler wraps the client connection in it before the handshake.
+// On success, the user is the one of the identity the selector attaches
+// to the connection it returns.
+type authConn struct {
+	net.Conn
+	user  string
+	check func(user string) error
+}
+
+// Attempt implements AuthAttempt.
+func (c *authConn) Attempt(user string) error {
+	c.user = user
+	if c.check != nil {
+		return c.check(user)
+	}
+	return nil
+}
+
+// sessionSelector reports the negotiated method, the authentication and the identity
+// to the session, and to the guard if any.
+// With reject set, no method is acceptable and the handshake fails with reject,
+// without authenticating.
+type sessionSelector struct {
+	gosocks5.Selector
+	sess   *Session
+	guard  *AuthGuard
+	reject error
+}
+
+func (selector *sessionSelector) Select(methods ...uint8) uint8 {
+	method := uint8(gosocks5.MethodNoAcceptable)
+	if selector.reject == nil {
+		method = selector.Selector.Select(methods...)
+	}
+	// A blocked source IP may not use any method which authenticates,
+	// whether the selector reports the user or not, and is told so before trying.
+	if selector.guard != nil && method != gosocks5.MethodNoAuth && method != gosocks5.MethodNoAcceptable {
+		if err := selector.guard.check(addrIP(selector.sess.RemoteAddr).String(), ""); err != nil {
+			selector.sess.onAuthFail(method, "", err)
+			selector.reject, method = err, gosocks5.MethodNoAcceptable
+		}
+	}
+	selector.sess.onMethod(method)
+	return method
+}
+
+func (selector *sessionSelector) OnSelected(method uint8, conn net.Conn) (net.Conn, error) {
+	if selector.reject != nil {
+		return nil, selector.reject
+	}
+	ip := addrIP(selector.sess.RemoteAddr).String()
+	c, err := selector.Selector.OnSelected(method, conn)
 	if err != nil {
-		gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
-		return err
+		var user string
+		if ac, ok := conn.(*authConn); ok {
+			user = ac.user
+		}
+		selector.sess.onAuthFail(method, user, err)
+		if selector.guard != nil && err == gosocks5.ErrAuthFailure {
+			for _, lockout := range selector.guard.fail(ip, user) {
+				selector.sess.onLockout(lockout)
+			}
+		}
+		return nil, err
 	}
 
-	socksAddr := toSocksAddr(ln.Addr())
-	// Issue: may not reachable when host has multi-interface
-	socksAddr.Host, _, _ = net.SplitHostPort(conn.LocalAddr().String())
-	reply := gosocks5.NewReply(gosocks5.Succeeded, socksAddr)
-	if err := reply.Write(conn); err != nil {
-		ln.Close()
-		return err
+	var user string
+	if ic, ok := c.(interface{ Identity() *gosocks5.Identity }); ok && ic.Identity() != nil {
+		selector.sess.identify(ic.Identity())
+		user = ic.Identity().User
+	}
+	if selector.guard != nil && method != gosocks5.MethodNoAuth {
+		selector.guard.succeed(ip, user)
 	}
+	selector.sess.onAuth(user)
+	return c, nil
+}
 
-	var pconn net.Conn
-	accept := func() <-chan error {
-		errc := make(chan error, 1)
+func (h *serverHandler) Handle(conn net.Conn) error {
+	sess := withSession(conn).sess
+	opts := sess.opts
+
+	// A source IP over its limit is refused any method, so that it cannot even try to authenticate.
+	var ipErr error
+	if h.sessions != nil {
+		release, err := h.sessions.acquireIP(addrIP(sess.RemoteAddr).String())
+		if err != nil {
+			ipErr = err
+		} else {
+			defer release()
+		}
+	}
+	ac := &authConn{Conn: conn}
+	if h.guard != nil {
+		ip := addrIP(sess.RemoteAddr).String()
+		ac.check = func(user string) error {
+			return h.guard.check(ip, user)
+		}
+	}
+	sc := gosocks5.ServerConn(ac, &sessionSelector{Selector: h.selector, sess: sess, guard: h.guard, reject: ipErr})
 
-		go func() {
-			defer close(errc)
-			defer ln.Close()
+	setTimeout(conn, opts.HandshakeTimeout)
+	if err := sc.Handleshake(); err != nil {
+		if ipErr != nil {
+			h.logf("limit: src=%s rejected: %v", sess.RemoteAddr, ipErr)
+		}
+		return err
+	}
+	setTimeout(conn, opts.ReadTimeout)
+	req, err := gosocks5.ReadRequest(sc)
+	if err != nil {
+		// A malformed request still gets a reply, a broken connection does not.
+		switch err {
+		case gosocks5.ErrBadAddrType, gosocks5.ErrBadVersion:
+			return sess.replyError(sc, err)
+		}
+		return err
+	}
+	setTimeout(conn, 0)
+	sess.onRequest(req)
+
+	// Users over a limit are rejected once the request is read, so that the client gets a reply.
+	if h.sessions != nil && sess.User != "" {
+		release, err := h.sessions.acquireUser(sess.User)
+		if err != nil {
+			h.logf("limit: user=%q src=%s request %s rejected: %v", sess.User, sess.RemoteAddr, req, err)
+			return sess.replyError(sc, err)
+		}
+		defer release()
+	}
 
-			c, err := ln.AcceptTCP()
-			if err != nil {
-				errc <- err
-				return
-			}
-			pconn = c
-		}()
+	if !h.allowed(sess, req) {
+		h.logf("policy: user=%q src=%s request %s rejected", sess.User, sess.RemoteAddr, req)
+		return sess.replyError(sc, errNotAllowed)
+	}
 
-		return errc
+	if h.limiter != nil {
+		sess.rate = h.limiter.open(sess.User, addrIP(sess.RemoteAddr).String())
+		defer sess.rate.close()
+	}
+	if h.sched != nil {
+		sess.sched = h.sched
+		sess.class = h.sched.Classify(sess.User, req.Addr.Port)
 	}
 
-	pc1, pc2 := net.Pipe()
-	pipe := func() <-chan error {
-		errc := make(chan error, 1)
+	return h.serveCommand(sess.ctx, sc, req)
+}
 
-		go func() {
-			defer close(errc)
-			defer pc1.Close()
+func (h *serverHandler) handleConnect(ctx context.Context, conn net.Conn, req *gosocks5.Request) error {
+	sess := sessionOf(ctx)
+	opts := sess.opts
 
-			errc <- transport(conn, pc1)
-		}()
+	if opts.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.DialTimeout)
+		defer cancel()
+	}
 
-		return errc
+	var cc net.Conn
+	var err error
+	dialer := h.dialer
+	start := time.Now()
+	if h.router != nil && req.Addr.Type == gosocks5.AddrDomain && h.router.matchesNetworks() {
+		cc, dialer, err = h.dialRouted(ctx, sess, req.Addr)
+	} else {
+		if h.router != nil {
+			dialer = h.router.Route(sess.User, sess.RemoteAddr, req.Addr)
+		}
+		cc, err = h.dial(ctx, dialer, req.Addr)
 	}
+	sess.onDial(req.Addr, time.Since(start), err)
+	if err != nil {
+		return sess.replyError(conn, err)
+	}
+	defer cc.Close()
 
-	defer pc2.Close()
+	if egress, ok := dialer.(*Egress); ok && egress.ProxyProtocol > 0 {
+		if _, err := proxyHeaderFor(sess, conn, egress).WriteTo(cc); err != nil {
+			return sess.replyError(conn, err)
+		}
+	}
 
-	for {
-		select {
-		case err := <-accept():
-			if err != nil || pconn == nil {
-				return err
-			}
-			defer pconn.Close()
+	if err := sess.reply(conn, gosocks5.Succeeded, nil); err != nil {
+		return err
+	}
+	sess.onConnect(cc)
 
-			reply := gosocks5.NewReply(gosocks5.Succeeded, toSocksAddr(pconn.RemoteAddr()))
-			if err := reply.Write(pc2); err != nil {
-				return err
-			}
+	stats := transport(conn, cc, sess)
+	sess.onRelayDone(stats)
+	return stats.Err
+}
 
-			if err = transport(pc2, pconn); err != nil {
-			}
+// proxyHeaderFor returns the PROXY protocol header telling the destination
+// about the client of the session, as conn is connected to it.
+func proxyHeaderFor(sess *Session, conn net.Conn, egress *Egress) *ProxyHeader {
+	h := &ProxyHeader{
+		Version:     egress.ProxyProtocol,
+		Command:     ProxyProxy,
+		Source:      sess.RemoteAddr,
+		Destination: conn.LocalAddr(),
+	}
+	if egress.ProxyProtocolTLVs && h.Version == 2 {
+		if sess.User != "" {
+			h.TLVs = append(h.TLVs, ProxyTLV{Type: ProxyTLVUser, Value: []byte(sess.User)})
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: ProxyTLVUniqueID, Value: []byte(sess.ID)})
+	}
+	return h
+}
+
+// dial connects to addr with dialer, resolving the host name first if the handler has a resolver.
+// The resolved addresses are tried in order.
+func (h *serverHandler) dial(ctx context.Context, dialer Dialer, addr *gosocks5.Addr) (net.Conn, error) {
+	if h.resolver == nil || addr.Type != gosocks5.AddrDomain {
+		return dialer.DialContext(ctx, "tcp", addr.String())
+	}
 
-			return err
-		case err := <-pipe():
-			ln.Close()
-			return err
+	ips, err := h.lookup(ctx, addr.Host)
+	if err != nil {
+		return nil, err
+	}
+	port := strconv.Itoa(int(addr.Port))
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
 		}
 	}
+	return nil, err
 }
 
-func transport(rw1, rw2 io.ReadWriter) error {
-	errc := make(chan error, 1)
-	go func() {
-		buf := trPool.Get().([]byte)
-		defer trPool.Put(buf)
+// dialRouted resolves the name of addr, and connects to its addresses in turn,
+// each through the egress the router picks for it.
+func (h *serverHandler) dialRouted(ctx context.Context, sess *Session, addr *gosocks5.Addr) (net.Conn, Dialer, error) {
+	ips, err := h.lookup(ctx, addr.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+	port := strconv.Itoa(int(addr.Port))
+	for _, ip := range ips {
+		egress := h.router.route(sess.User, sess.RemoteAddr, addr, ip)
+		var conn net.Conn
+		conn, err = egress.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, egress, nil
+		}
+	}
+	return nil, nil, err
+}
 
-		_, err := io.CopyBuffer(rw1, rw2, buf)
-		errc <- err
-	}()
+// lookup resolves host with the handler's resolver, or the default one.
+func (h *serverHandler) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	var resolver Resolver = net.DefaultResolver
+	if h.resolver != nil {
+		resolver = h.resolver
+	}
 
-	go func() {
-		buf := trPool.Get().([]byte)
-		defer trPool.Put(buf)
+	ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ipAddrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	ips := make([]net.IP, 0, len(ipAddrs))
+	for _, ipAddr := range ipAddrs {
+		ips = append(ips, ipAddr.IP)
+	}
+	return ips, nil
+}
 
-		_, err := io.CopyBuffer(rw2, rw1, buf)
-		errc <- err
-	}()
+func (h *serverHandler) logf(format string, v ...interface{}) {
+	if h.logger != nil {
+		h.logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
 
-	err := <-errc
-	if err != nil && err == io.EOF {
-		err = nil
+// setTimeout sets the deadline of conn to timeout from now, or clears it if timeout is zero.
+func setTimeout(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		return
 	}
-	return err
+	conn.SetDeadline(time.Time{})
 }
 
 func toSocksAddr(addr net.Addr) *gosocks5.Addr {
-	host := "0.0.0.0"
-	port := 0
 	if addr != nil {
-		h, p, _ := net.SplitHostPort(addr.String())
-		host = h
-		port, _ = strconv.Atoi(p)
+		if socksAddr, err := gosocks5.NewAddr(addr.String()); err == nil {
+			return socksAddr
+		}
 	}
 	return &gosocks5.Addr{
 		Type: gosocks5.AddrIPv4,
-		Host: host,
-		Port: uint16(port),
+		Host: "0.0.0.0",
+	}
+}
+
+// serveCommand dispatches the request to the handler of the mux for req.Cmd,
+// or to the built-in one.
+func (h *serverHandler) serveCommand(ctx context.Context, conn net.Conn, req *gosocks5.Request) error {
+	if h.mux != nil {
+		if handler := h.mux.Handler(req.Cmd); handler != nil {
+			return handler.ServeCommand(ctx, conn, req)
+		}
+	}
+	return h.builtins.ServeCommand(ctx, conn, req)
+}
+
+// allowed reports whether all the policies allow the request of the session.
+func (h *serverHandler) allowed(sess *Session, req *gosocks5.Request) bool {
+	for _, allow := range h.policies {
+		if !allow(sess.User, sess.RemoteAddr, req) {
+			return false
+		}
 	}
+	return true
 }
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// encodeRequest returns the bytes of a request for addr.
+func encodeRequest(tb testing.TB, cmd uint8, addr string) []byte {
+	a, err := gosocks5.NewAddr(addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := gosocks5.NewRequest(cmd, a).Write(&b); err != nil {
+		tb.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// refusedAddr returns a loopback address nothing listens on.
+func refusedAddr(tb testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestHandlerReplies(t *testing.T) {
+	deny := func(user string, src net.Addr, req *gosocks5.Request) bool {
+		return false
+	}
+	tests := []struct {
+		name string
+		opts []HandlerOption
+		req  []byte
+		rep  uint8
+	}{
+		{
+			name: "unsupported command",
+			req:  encodeRequest(t, 0x7f, "127.0.0.1:80"),
+			rep:  gosocks5.CmdUnsupported,
+		},
+		{
+			name: "bad address type",
+			req:  []byte{gosocks5.Ver5, gosocks5.CmdConnect, 0, 0x09, 0, 0, 0},
+			rep:  gosocks5.AddrUnsupported,
+		},
+		{
+			name: "policy rejection",
+			opts: []HandlerOption{PolicyHandlerOption(deny)},
+			req:  encodeRequest(t, gosocks5.CmdConnect, "127.0.0.1:80"),
+			rep:  gosocks5.NotAllowed,
+		},
+		{
+			name: "refused dial",
+			req:  encodeRequest(t, gosocks5.CmdConnect, refusedAddr(t)),
+			rep:  gosocks5.ConnRefused,
+		},
+		{
+			name: "bind listen failure",
+			// 192.0.2.1 is reserved for documentation, no interface has it.
+			opts: []HandlerOption{BindHandlerOption(&BindOptions{ListenIP: net.ParseIP("192.0.2.1")})},
+			req:  encodeRequest(t, gosocks5.CmdBind, "0.0.0.0:0"),
+			rep:  gosocks5.Failure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := tcpPair(t)
+			defer client.Close()
+
+			opts := append(tt.opts, LoggerHandlerOption(log.New(ioutil.Discard, "", 0)))
+			h := NewHandler(opts...)
+			done := make(chan error, 1)
+			go func() {
+				done <- h.Handle(conn)
+				conn.Close()
+			}()
+
+			cc := gosocks5.ClientConn(client, nil)
+			if err := cc.Handleshake(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cc.Write(tt.req); err != nil {
+				t.Fatal(err)
+			}
+			reply, err := gosocks5.ReadReply(cc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Rep != tt.rep {
+				t.Errorf("reply %d, want %d", reply.Rep, tt.rep)
+			}
+			if err := <-done; err == nil {
+				t.Error("handler succeeded")
+			}
+		})
+	}
+}
+
+func TestHandlerKeepsMux(t *testing.T) {
+	mux := NewServeMux()
+	NewHandler(MuxHandlerOption(mux))
+	for _, cmd := range []uint8{gosocks5.CmdConnect, gosocks5.CmdBind, gosocks5.CmdUdp} {
+		if mux.Handler(cmd) != nil {
+			t.Errorf("command %d registered on the mux", cmd)
+		}
+	}
+}
+
+// udpEcho returns a UDP server echoing datagrams on loopback.
+func udpEcho(tb testing.TB) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(b[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPPolicy(t *testing.T) {
+	denied, allowed := udpEcho(t), udpEcho(t)
+	defer denied.Close()
+	defer allowed.Close()
+	deniedPort := uint16(denied.LocalAddr().(*net.UDPAddr).Port)
+	policy := func(user string, src net.Addr, req *gosocks5.Request) bool {
+		return req.Addr.Port != deniedPort
+	}
+
+	client, conn := tcpPair(t)
+	defer client.Close()
+	h := NewHandler(PolicyHandlerOption(policy), LoggerHandlerOption(log.New(ioutil.Discard, "", 0)))
+	go func() {
+		h.Handle(conn)
+		conn.Close()
+	}()
+	cc := gosocks5.ClientConn(client, nil)
+	if _, err := cc.Write(encodeRequest(t, gosocks5.CmdUdp, "0.0.0.0:0")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := gosocks5.ReadReply(cc)
+	if err != nil || reply.Rep != gosocks5.Succeeded {
+		t.Fatal(reply, err)
+	}
+	relay, err := net.ResolveUDPAddr("udp", reply.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	for _, dst := range []net.Addr{denied.LocalAddr(), allowed.LocalAddr()} {
+		addr, _ := gosocks5.NewAddr(dst.String())
+		var b bytes.Buffer
+		gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, addr), []byte("ping")).Write(&b)
+		if _, err := uc.Write(b.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uc.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1024)
+	n, err := uc.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(b[:n]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgram.Header.Addr.String() != allowed.LocalAddr().String() {
+		t.Errorf("reply from %s, want %s", dgram.Header.Addr, allowed.LocalAddr())
+	}
+	uc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := uc.Read(b); err == nil {
+		t.Error("datagram to a denied destination relayed")
+	}
+}
+
+func TestAuthGuardBlocksMethod(t *testing.T) {
+	guard := NewAuthGuard(AuthLimits{MaxFailures: 1})
+	guard.fail("127.0.0.1", "")
+
+	client, conn := tcpPair(t)
+	defer client.Close()
+
+	users := []*url.Userinfo{url.UserPassword("user", "pass")}
+	h := NewHandler(
+		SelectorHandlerOption(NewServerSelector(users, gosocks5.MethodUserPass)),
+		AuthGuardHandlerOption(guard),
+		LoggerHandlerOption(log.New(ioutil.Discard, "", 0)),
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Handle(conn)
+		conn.Close()
+	}()
+
+	if _, err := client.Write([]byte{gosocks5.Ver5, 1, gosocks5.MethodUserPass}); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(client, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[1] != gosocks5.MethodNoAcceptable {
+		t.Errorf("method %d, want %d", b[1], gosocks5.MethodNoAcceptable)
+	}
+	if err := <-done; err != ErrAuthBlocked {
+		t.Errorf("handler error %v, want %v", err, ErrAuthBlocked)
+	}
+}
+
+func TestBindAdvertisesLocalIP(t *testing.T) {
+	client, conn := tcpPair(t)
+	defer client.Close()
+
+	h := NewHandler(
+		BindHandlerOption(&BindOptions{ListenIP: net.IPv4zero, AcceptTimeout: time.Second}),
+		LoggerHandlerOption(log.New(ioutil.Discard, "", 0)),
+	)
+	go func() {
+		h.Handle(conn)
+		conn.Close()
+	}()
+
+	cc := gosocks5.ClientConn(client, nil)
+	if err := cc.Handleshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.Write(encodeRequest(t, gosocks5.CmdBind, "0.0.0.0:0")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := gosocks5.ReadReply(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rep != gosocks5.Succeeded || reply.Addr.Host != "127.0.0.1" || reply.Addr.Port == 0 {
+		t.Errorf("reply %d %v, want %d 127.0.0.1:<port>", reply.Rep, reply.Addr, gosocks5.Succeeded)
+	}
+}
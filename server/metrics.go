@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+var (
+	// latencyBuckets are the histogram buckets of the handshake and dial durations, in seconds.
+	latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// sessionBuckets are the histogram buckets of the session durations, in seconds.
+	sessionBuckets = []float64{.1, 1, 10, 30, 60, 300, 600, 1800, 3600, 7200}
+)
+
+// Metrics counts the sessions served through its middleware,
+// and exposes the counts in the Prometheus text format as an http.Handler.
+// Bytes are counted once a relay ends.
+type Metrics struct {
+	mu           sync.Mutex
+	active       int64
+	sessions     map[[2]string]uint64 // by command and reply
+	authFailures map[string]uint64    // by method
+	rejected     map[string]uint64    // by limit
+	bytes        map[[2]string]uint64 // by user and direction
+	handshake    *histogram
+	dial         *histogram
+	duration     *histogram
+}
+
+// NewMetrics creates an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		sessions:     make(map[[2]string]uint64),
+		authFailures: make(map[string]uint64),
+		rejected:     make(map[string]uint64),
+		bytes:        make(map[[2]string]uint64),
+		handshake:    newHistogram(latencyBuckets),
+		dial:         newHistogram(latencyBuckets),
+		duration:     newHistogram(sessionBuckets),
+	}
+}
+
+// Middleware returns a middleware counting the sessions of the handler it wraps.
+func (m *Metrics) Middleware() Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) (err error) {
+			sc := withSession(conn)
+			sess := sc.sess
+
+			m.mu.Lock()
+			m.active++
+			m.mu.Unlock()
+
+			replied := false
+			var rep uint8
+			sess.hooks = append(sess.hooks, &Hooks{
+				OnAuth: func(ctx context.Context, user string) {
+					m.observe(m.handshake, time.Since(sess.Start))
+				},
+				OnAuthFail: func(ctx context.Context, method uint8, user string, err error) {
+					m.mu.Lock()
+					m.authFailures[methodName(method)]++
+					m.mu.Unlock()
+				},
+				OnDial: func(ctx context.Context, dst *gosocks5.Addr, d time.Duration, err error) {
+					m.observe(m.dial, d)
+				},
+				OnReply: func(ctx context.Context, r uint8) {
+					replied, rep = true, r
+				},
+				OnRelayDone: func(ctx context.Context, stats *RelayStats) {
+					m.mu.Lock()
+					m.bytes[[2]string{sess.User, "up"}] += uint64(stats.Up)
+					m.bytes[[2]string{sess.User, "down"}] += uint64(stats.Down)
+					m.mu.Unlock()
+				},
+			})
+
+			defer func() {
+				cmd, reply := "none", "none"
+				if sess.Request != nil {
+					cmd = commandName(sess.Request.Cmd)
+				}
+				if replied {
+					reply = replyName(rep)
+				}
+				var limitErr *LimitError
+				m.mu.Lock()
+				if errors.As(err, &limitErr) {
+					m.rejected[limitErr.Reason]++
+				}
+				m.active--
+				m.sessions[[2]string{cmd, reply}]++
+				m.duration.observe(time.Since(sess.Start).Seconds())
+				m.mu.Unlock()
+			}()
+			return h.Handle(sc)
+		})
+	}
+}
+
+func (m *Metrics) observe(h *histogram, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h.observe(d.Seconds())
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	m.write(bw)
+	bw.Flush()
+}
+
+func (m *Metrics) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "socks5_active_sessions", "gauge", "Sessions being served.")
+	fmt.Fprintf(w, "socks5_active_sessions %d\n", m.active)
+
+	writeHeader(w, "socks5_sessions_total", "counter", "Sessions served, by command and reply code.")
+	for _, k := range sortedKeys2(m.sessions) {
+		fmt.Fprintf(w, "socks5_sessions_total{command=%s,reply=%s} %d\n",
+			quoteLabel(k[0]), quoteLabel(k[1]), m.sessions[k])
+	}
+
+	writeHeader(w, "socks5_auth_failures_total", "counter", "Failed method negotiations and authentications, by method.")
+	writeCounters(w, "socks5_auth_failures_total", "method", m.authFailures)
+
+	writeHeader(w, "socks5_rejected_sessions_total", "counter", "Sessions rejected by the session limits, by limit.")
+	writeCounters(w, "socks5_rejected_sessions_total", "limit", m.rejected)
+
+	writeHeader(w, "socks5_relayed_bytes_total", "counter", "Bytes relayed, by user and direction.")
+	for _, k := range sortedKeys2(m.bytes) {
+		fmt.Fprintf(w, "socks5_relayed_bytes_total{user=%s,direction=%s} %d\n",
+			quoteLabel(k[0]), quoteLabel(k[1]), m.bytes[k])
+	}
+
+	writeHeader(w, "socks5_handshake_duration_seconds", "histogram", "Time from accept to authentication.")
+	m.handshake.write(w, "socks5_handshake_duration_seconds")
+	writeHeader(w, "socks5_dial_duration_seconds", "histogram", "Time to connect to the destination of CONNECT requests.")
+	m.dial.write(w, "socks5_dial_duration_seconds")
+	writeHeader(w, "socks5_session_duration_seconds", "histogram", "Time from accept to the end of the session.")
+	m.duration.write(w, "socks5_session_duration_seconds")
+}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // one per bound, plus +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) write(w *bufio.Writer, name string) {
+	var n uint64
+	for i, bound := range h.bounds {
+		n += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), n)
+	}
+	n += h.counts[len(h.bounds)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, n)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, n)
+}
+
+// writeCounters writes the counters of a metric with a single label.
+func writeCounters(w *bufio.Writer, name, label string, counters map[string]uint64) {
+	keys := make([]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, label, quoteLabel(k), counters[k])
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func sortedKeys2(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+func methodName(method uint8) string {
+	switch method {
+	case gosocks5.MethodNoAuth:
+		return "no_auth"
+	case gosocks5.MethodGSSAPI:
+		return "gssapi"
+	case gosocks5.MethodUserPass:
+		return "user_pass"
+	case gosocks5.MethodNoAcceptable:
+		return "no_acceptable"
+	}
+	return strconv.Itoa(int(method))
+}
+
+func commandName(cmd uint8) string {
+	switch cmd {
+	case gosocks5.CmdConnect:
+		return "connect"
+	case gosocks5.CmdBind:
+		return "bind"
+	case gosocks5.CmdUdp:
+		return "udp_associate"
+	}
+	return strconv.Itoa(int(cmd))
+}
+
+func replyName(rep uint8) string {
+	switch rep {
+	case gosocks5.Succeeded:
+		return "succeeded"
+	case gosocks5.Failure:
+		return "failure"
+	case gosocks5.NotAllowed:
+		return "not_allowed"
+	case gosocks5.NetUnreachable:
+		return "net_unreachable"
+	case gosocks5.HostUnreachable:
+		return "host_unreachable"
+	case gosocks5.ConnRefused:
+		return "connection_refused"
+	case gosocks5.TTLExpired:
+		return "ttl_expired"
+	case gosocks5.CmdUnsupported:
+		return "command_unsupported"
+	case gosocks5.AddrUnsupported:
+		return "address_unsupported"
+	}
+	return strconv.Itoa(int(rep))
+}
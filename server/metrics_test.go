@@ -0,0 +1,62 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+func TestMetricsDial(t *testing.T) {
+	deny := func(user string, src net.Addr, req *gosocks5.Request) bool {
+		return false
+	}
+	tests := []struct {
+		name  string
+		opts  []HandlerOption
+		dials uint64
+	}{
+		{name: "policy rejection", opts: []HandlerOption{PolicyHandlerOption(deny)}, dials: 0},
+		{name: "refused dial", dials: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := tcpPair(t)
+			defer client.Close()
+
+			m := NewMetrics()
+			opts := append(tt.opts, LoggerHandlerOption(log.New(ioutil.Discard, "", 0)))
+			h := Chain(NewHandler(opts...), m.Middleware())
+			done := make(chan error, 1)
+			go func() {
+				done <- h.Handle(conn)
+				conn.Close()
+			}()
+
+			cc := gosocks5.ClientConn(client, nil)
+			if err := cc.Handleshake(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cc.Write(encodeRequest(t, gosocks5.CmdConnect, refusedAddr(t))); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := gosocks5.ReadReply(cc); err != nil {
+				t.Fatal(err)
+			}
+			<-done
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			var dials uint64
+			for _, n := range m.dial.counts {
+				dials += n
+			}
+			if dials != tt.dials {
+				t.Errorf("%d dials observed, want %d", dials, tt.dials)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// The HandlerFunc type is an adapter to allow the use of ordinary functions as handlers.
+type HandlerFunc func(conn net.Conn) error
+
+// Handle calls f(conn).
+func (f HandlerFunc) Handle(conn net.Conn) error {
+	return f(conn)
+}
+
+// Middleware wraps a Handler to add behaviour around it.
+// A middleware which wraps the connection before passing it on must give access
+// to the connection it got through a NetConn() net.Conn method, as *tls.Conn does,
+// so that the handlers after it find the session of the server.
+type Middleware func(h Handler) Handler
+
+// Chain wraps h with the middlewares, the first one being the outermost.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// RelayStats describes a finished relay.
+type RelayStats struct {
+	// Up is the number of bytes relayed from the client, Down the number relayed to it.
+	Up, Down int64
+	// UpErr and DownErr are the errors which ended each direction, nil for EOF.
+	UpErr, DownErr error
+	// Duration is how long the relay lasted.
+	Duration time.Duration
+	// Err is the error which ended the relay, if any.
+	Err error
+}
+
+// Hooks are called by the handler as a session progresses.
+// Each hook receives the context of the session, see SessionFromContext.
+// Nil hooks are skipped.
+type Hooks struct {
+	// OnAccept is called when the connection reaches the middleware.
+	OnAccept func(ctx context.Context, conn net.Conn)
+	// OnMethod is called once the method is negotiated.
+	OnMethod func(ctx context.Context, method uint8)
+	// OnAuth is called once the client is authenticated, or needs not be.
+	OnAuth func(ctx context.Context, user string)
+	// OnAuthFail is called when the client fails to negotiate a method or to authenticate,
+	// with the user name it tried if the method has one.
+	OnAuthFail func(ctx context.Context, method uint8, user string, err error)
+	// OnLockout is called when a failure of the client locks its source IP or its user out.
+	OnLockout func(ctx context.Context, lockout *Lockout)
+	// OnRequest is called once the request is read.
+	OnRequest func(ctx context.Context, req *gosocks5.Request)
+	// OnReply is called for each reply sent to the client.
+	OnReply func(ctx context.Context, rep uint8)
+	// OnDial is called when connecting to the destination of a CONNECT request ends,
+	// with how long it took, name resolution included, and the error if it failed.
+	OnDial func(ctx context.Context, dst *gosocks5.Addr, d time.Duration, err error)
+	// OnConnect is called once the connection to the destination or the BIND peer is made.
+	OnConnect func(ctx context.Context, upstream net.Conn)
+	// OnRelayDone is called when the relay ends.
+	OnRelayDone func(ctx context.Context, stats *RelayStats)
+}
+
+// HooksMiddleware returns a middleware calling hooks for each session of the handler it wraps.
+// Panics in the hooks or the handler are recovered and returned as errors.
+func HooksMiddleware(hooks *Hooks) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) (err error) {
+			defer recoverPanic(&err, nil)
+
+			sc := withSession(conn)
+			sc.sess.hooks = append(sc.sess.hooks, hooks)
+			if hooks.OnAccept != nil {
+				hooks.OnAccept(sc.sess.ctx, sc.Conn)
+			}
+			return h.Handle(sc)
+		})
+	}
+}
+
+// RecoverMiddleware returns a middleware recovering panics in the handler it wraps.
+// The panic is logged with its stack trace to logger, or the standard logger if nil,
+// and returned as an error.
+func RecoverMiddleware(logger *log.Logger) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) (err error) {
+			defer recoverPanic(&err, logger)
+			return h.Handle(conn)
+		})
+	}
+}
+
+func recoverPanic(err *error, logger *log.Logger) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	buf := make([]byte, 64<<10)
+	buf = buf[:runtime.Stack(buf, false)]
+	*err = fmt.Errorf("panic: %v", v)
+	if logger != nil {
+		logger.Printf("server: panic serving session: %v\n%s", v, buf)
+		return
+	}
+	log.Printf("server: panic serving session: %v\n%s", v, buf)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// wrapConn is a connection wrapped by a middleware.
+type wrapConn struct {
+	net.Conn
+}
+
+func (c *wrapConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func TestMiddlewareWrappingConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	var connects int32
+	hooks := &Hooks{
+		OnConnect: func(ctx context.Context, upstream net.Conn) {
+			atomic.AddInt32(&connects, 1)
+		},
+	}
+	wrap := func(h Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) error {
+			return h.Handle(&wrapConn{conn})
+		})
+	}
+	h := Chain(NewHandler(LoggerHandlerOption(log.New(ioutil.Discard, "", 0))), HooksMiddleware(hooks), wrap)
+
+	srv, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Listener: srv}
+	defer s.Close()
+	go s.Serve(h, IdleTimeoutServerOption(200*time.Millisecond), ErrorLogServerOption(log.New(ioutil.Discard, "", 0)))
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cc := gosocks5.ClientConn(conn, nil)
+	if _, err := cc.Write(encodeRequest(t, gosocks5.CmdConnect, ln.Addr().String())); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := gosocks5.ReadReply(cc); err != nil || reply.Rep != gosocks5.Succeeded {
+		t.Fatal(reply, err)
+	}
+
+	// The idle timeout of the server ends the relay.
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(2 * time.Second))
+	if _, err := cc.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("relay lasted %v", d)
+	}
+	if n := atomic.LoadInt32(&connects); n != 1 {
+		t.Errorf("OnConnect fired %d times", n)
+	}
+}
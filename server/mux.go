@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// CommandHandler handles a request once the handshake is done and the request has been read.
+// The context carries the Session, see SessionFromContext.
+type CommandHandler interface {
+	ServeCommand(ctx context.Context, conn net.Conn, req *gosocks5.Request) error
+}
+
+// The CommandHandlerFunc type is an adapter to allow the use of ordinary functions as command handlers.
+type CommandHandlerFunc func(ctx context.Context, conn net.Conn, req *gosocks5.Request) error
+
+// ServeCommand calls f(ctx, conn, req).
+func (f CommandHandlerFunc) ServeCommand(ctx context.Context, conn net.Conn, req *gosocks5.Request) error {
+	return f(ctx, conn, req)
+}
+
+// ServeMux dispatches requests to command handlers by Request.Cmd,
+// replying CmdUnsupported to the commands with no handler.
+// The handler created by NewHandler serves the commands its mux has no handler for
+// with its built-in CONNECT, BIND and UDP ASSOCIATE handlers.
+type ServeMux struct {
+	mu sync.RWMutex
+	m  map[uint8]CommandHandler
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{
+		m: make(map[uint8]CommandHandler),
+	}
+}
+
+// Handle registers the handler for the command, replacing any previous one.
+func (mux *ServeMux) Handle(cmd uint8, handler CommandHandler) {
+	if handler == nil {
+		panic("server: nil command handler")
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if mux.m == nil {
+		mux.m = make(map[uint8]CommandHandler)
+	}
+	mux.m[cmd] = handler
+}
+
+// HandleFunc registers the handler function for the command.
+func (mux *ServeMux) HandleFunc(cmd uint8, handler func(ctx context.Context, conn net.Conn, req *gosocks5.Request) error) {
+	mux.Handle(cmd, CommandHandlerFunc(handler))
+}
+
+// Handler returns the handler registered for the command, or nil.
+func (mux *ServeMux) Handler(cmd uint8) CommandHandler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	return mux.m[cmd]
+}
+
+// ServeCommand dispatches the request to the handler registered for req.Cmd.
+func (mux *ServeMux) ServeCommand(ctx context.Context, conn net.Conn, req *gosocks5.Request) error {
+	h := mux.Handler(req.Cmd)
+	if h == nil {
+		sessionOf(ctx).reply(conn, gosocks5.CmdUnsupported, nil)
+		return fmt.Errorf("unsupported command %d", req.Cmd)
+	}
+	return h.ServeCommand(ctx, conn, req)
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout limits reading a PROXY protocol header when the server has no handshake timeout.
+	proxyHeaderTimeout = 10 * time.Second
+
+	proxyV1MaxLen = 107
+)
+
+// proxyV2Sig starts a PROXY protocol version 2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Commands of a PROXY protocol header.
+const (
+	// ProxyLocal is sent by the proxy for its own connections, such as health checks.
+	// The addresses of the connection are the real ones.
+	ProxyLocal = 0
+	// ProxyProxy is sent for relayed connections.
+	ProxyProxy = 1
+)
+
+// Types of the PROXY protocol TLVs sent by the server.
+const (
+	// ProxyTLVUniqueID holds the session ID.
+	ProxyTLVUniqueID = 0x05
+	// ProxyTLVUser holds the name of the authenticated user, in the range of custom types.
+	ProxyTLVUser = 0xE0
+)
+
+// ProxyTLV is a type-length-value field of a PROXY protocol version 2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a HAProxy PROXY protocol header.
+type ProxyHeader struct {
+	// Version is 1 or 2.
+	Version int
+	// Command is ProxyLocal or ProxyProxy.
+	Command int
+	// Source and Destination are the addresses of the original connection,
+	// nil if the proxy does not know them.
+	Source, Destination net.Addr
+	// TLVs are the additional fields of a version 2 header.
+	TLVs []ProxyTLV
+}
+
+// TLV returns the value of the first field of the type, or nil.
+func (h *ProxyHeader) TLV(typ byte) []byte {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the header to w.
+func (h *ProxyHeader) WriteTo(w io.Writer) (int64, error) {
+	var b []byte
+	switch h.Version {
+	case 1:
+		b = h.appendV1(nil)
+	case 2:
+		var err error
+		if b, err = h.appendV2(nil); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("proxy protocol: bad version %d", h.Version)
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// proxyAddrs returns the IPs and ports of a PROXY command, in the same family,
+// or ok false if the header cannot tell them.
+func (h *ProxyHeader) proxyAddrs() (src, dst net.IP, sport, dport int, ok bool) {
+	s, sok := h.Source.(*net.TCPAddr)
+	d, dok := h.Destination.(*net.TCPAddr)
+	if h.Command != ProxyProxy || !sok || !dok {
+		return nil, nil, 0, 0, false
+	}
+	src, dst = s.IP.To4(), d.IP.To4()
+	if src == nil || dst == nil {
+		src, dst = s.IP.To16(), d.IP.To16()
+	}
+	if src == nil || dst == nil {
+		return nil, nil, 0, 0, false
+	}
+	return src, dst, s.Port, d.Port, true
+}
+
+func (h *ProxyHeader) appendV1(b []byte) []byte {
+	src, dst, sport, dport, ok := h.proxyAddrs()
+	if !ok {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	if len(src) == net.IPv4len {
+		return append(b, fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src, dst, sport, dport)...)
+	}
+	return append(b, fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(src), ipv6String(dst), sport, dport)...)
+}
+
+// ipv6String formats ip in IPv6 notation, which net.IP.String does not for IPv4-mapped addresses.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func (h *ProxyHeader) appendV2(b []byte) ([]byte, error) {
+	var payload []byte
+	famProto := byte(0x00) // UNSPEC
+	if src, dst, sport, dport, ok := h.proxyAddrs(); ok {
+		famProto = 0x21 // AF_INET6, STREAM
+		if len(src) == net.IPv4len {
+			famProto = 0x11 // AF_INET, STREAM
+		}
+		payload = append(payload, src...)
+		payload = append(payload, dst...)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(sport))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(dport))
+	}
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xffff {
+			return nil, errors.New("proxy protocol: TLV too long")
+		}
+		payload = append(payload, tlv.Type)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+	if len(payload) > 0xffff {
+		return nil, errors.New("proxy protocol: header too long")
+	}
+
+	b = append(b, proxyV2Sig...)
+	b = append(b, 0x20|byte(h.Command&0x0f), famProto)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...), nil
+}
+
+// readProxyHeader reads a PROXY protocol header of either version from r.
+// It reads no further than the header.
+func readProxyHeader(r io.Reader) (*ProxyHeader, error) {
+	b := make([]byte, len(proxyV2Sig)+4)
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readProxyV1(r)
+	case proxyV2Sig[0]:
+		if _, err := io.ReadFull(r, b[1:]); err != nil {
+			return nil, err
+		}
+		return readProxyV2(r, b)
+	}
+	return nil, errors.New("proxy protocol: no header")
+}
+
+// readProxyV1 reads the text header after its first byte.
+func readProxyV1(r io.Reader) (*ProxyHeader, error) {
+	line := []byte{'P'}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("proxy protocol: v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("proxy protocol: bad v1 header")
+	}
+	h := &ProxyHeader{Version: 1, Command: ProxyProxy}
+	switch fields[1] {
+	case "UNKNOWN":
+		h.Command = ProxyLocal
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("proxy protocol: bad v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("proxy protocol: bad v1 header")
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("proxy protocol: bad v1 address %s %s", host, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 reads the binary header after its first 16 bytes in b.
+func readProxyV2(r io.Reader, b []byte) (*ProxyHeader, error) {
+	if !bytes.Equal(b[:len(proxyV2Sig)], proxyV2Sig) {
+		return nil, errors.New("proxy protocol: bad v2 signature")
+	}
+	verCmd, famProto := b[12], b[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol: bad version %d", verCmd>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(b[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2, Command: int(verCmd & 0x0f)}
+	if h.Command != ProxyLocal && h.Command != ProxyProxy {
+		return nil, fmt.Errorf("proxy protocol: bad command %d", h.Command)
+	}
+	// Only TCP connections are proxied.
+	if proto := famProto & 0x0f; proto != 0x0 && proto != 0x1 { // UNSPEC, STREAM
+		return nil, fmt.Errorf("proxy protocol: bad v2 transport %d", proto)
+	}
+
+	var n int
+	switch famProto >> 4 {
+	case 1: // AF_INET
+		n = 2*net.IPv4len + 4
+	case 2: // AF_INET6
+		n = 2*net.IPv6len + 4
+	case 3: // AF_UNIX
+		n = 216
+	}
+	if len(payload) < n {
+		return nil, errors.New("proxy protocol: v2 addresses too short")
+	}
+	if h.Command == ProxyProxy && (n == 2*net.IPv4len+4 || n == 2*net.IPv6len+4) {
+		l := (n - 4) / 2
+		h.Source = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[:l]...)),
+			Port: int(binary.BigEndian.Uint16(payload[2*l:])),
+		}
+		h.Destination = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[l:2*l]...)),
+			Port: int(binary.BigEndian.Uint16(payload[2*l+2:])),
+		}
+	}
+
+	for tlvs := payload[n:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, errors.New("proxy protocol: truncated TLV")
+		}
+		l := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+l {
+			return nil, errors.New("proxy protocol: truncated TLV")
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+l]})
+		tlvs = tlvs[3+l:]
+	}
+	return h, nil
+}
+
+// proxyConn is a connection accepted from a trusted proxy,
+// whose remote address is the one of the original client.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// NetConn returns the connection from the proxy.
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// acceptProxy reads the PROXY protocol header starting conn, and returns
+// the connection with the remote address of the client.
+func acceptProxy(conn net.Conn, timeout time.Duration) (net.Conn, *ProxyHeader, error) {
+	if timeout <= 0 {
+		timeout = proxyHeaderTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	h, err := readProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.Command == ProxyLocal || h.Source == nil {
+		return conn, h, nil
+	}
+	return &proxyConn{Conn: conn, remote: h.Source}, h, nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderWriteV1(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		want     string
+	}{
+		{"192.0.2.1:5", "198.51.100.1:9", "PROXY TCP4 192.0.2.1 198.51.100.1 5 9\r\n"},
+		{"[2001:db8::1]:5", "[2001:db8::2]:9", "PROXY TCP6 2001:db8::1 2001:db8::2 5 9\r\n"},
+		{"[::1]:5", "1.2.3.4:9", "PROXY TCP6 ::1 ::ffff:1.2.3.4 5 9\r\n"},
+		{"1.2.3.4:5", "[::1]:9", "PROXY TCP6 ::ffff:1.2.3.4 ::1 5 9\r\n"},
+	}
+	for _, tt := range tests {
+		src, _ := net.ResolveTCPAddr("tcp", tt.src)
+		dst, _ := net.ResolveTCPAddr("tcp", tt.dst)
+		h := &ProxyHeader{Version: 1, Command: ProxyProxy, Source: src, Destination: dst}
+		var b bytes.Buffer
+		if _, err := h.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s -> %s: got %q, want %q", tt.src, tt.dst, b.String(), tt.want)
+		}
+		if _, err := readProxyHeader(&b); err != nil {
+			t.Errorf("%s -> %s: %v", tt.src, tt.dst, err)
+		}
+	}
+}
+
+// proxyV2 returns a version 2 header with the command, family and transport byte, and payload.
+func proxyV2(cmd, famProto byte, payload ...byte) []byte {
+	b := append([]byte(nil), proxyV2Sig...)
+	b = append(b, 0x20|cmd, famProto, byte(len(payload)>>8), byte(len(payload)))
+	return append(b, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	inet := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0, 5, 0, 9}
+	tlv := []byte{ProxyTLVUser, 0, 3, 'b', 'o', 'b'}
+	tests := []struct {
+		name    string
+		in      []byte
+		command int
+		source  string // empty for none
+		err     bool
+	}{
+		{name: "v1 tcp4", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5 9\r\n"), command: ProxyProxy, source: "192.0.2.1:5"},
+		{name: "v1 tcp6", in: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 5 9\r\n"), command: ProxyProxy, source: "[2001:db8::1]:5"},
+		{name: "v1 unknown", in: []byte("PROXY UNKNOWN\r\n"), command: ProxyLocal},
+		{name: "v1 truncated", in: []byte("PROXY TCP4 192.0.2.1 198.51"), err: true},
+		{name: "v1 oversized", in: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...), err: true},
+		{name: "v1 bad protocol", in: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 5 9\r\n"), err: true},
+		{name: "v1 bad address", in: []byte("PROXY TCP4 192.0.2.1 example 5 9\r\n"), err: true},
+		{name: "v1 bad port", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5 70000\r\n"), err: true},
+		{name: "v1 missing fields", in: []byte("PROXY TCP4 192.0.2.1\r\n"), err: true},
+		{name: "v2 tcp4", in: proxyV2(ProxyProxy, 0x11, inet...), command: ProxyProxy, source: "192.0.2.1:5"},
+		{name: "v2 tcp4 tlv", in: proxyV2(ProxyProxy, 0x11, append(inet, tlv...)...), command: ProxyProxy, source: "192.0.2.1:5"},
+		{name: "v2 local", in: proxyV2(ProxyLocal, 0x00), command: ProxyLocal},
+		{name: "v2 local with addresses", in: proxyV2(ProxyLocal, 0x11, inet...), command: ProxyLocal},
+		{name: "v2 udp4", in: proxyV2(ProxyProxy, 0x12, inet...), err: true},
+		{name: "v2 udp6", in: proxyV2(ProxyProxy, 0x22, make([]byte, 36)...), err: true},
+		{name: "v2 bad command", in: proxyV2(0x2, 0x11, inet...), err: true},
+		{name: "v2 bad version", in: append(append([]byte(nil), proxyV2Sig...), 0x10|ProxyProxy, 0x11, 0, 0), err: true},
+		{name: "v2 bad signature", in: append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), err: true},
+		{name: "v2 short addresses", in: proxyV2(ProxyProxy, 0x11, inet[:8]...), err: true},
+		{name: "v2 truncated header", in: proxyV2(ProxyProxy, 0x11)[:14], err: true},
+		{name: "v2 truncated payload", in: proxyV2(ProxyProxy, 0x11, inet...)[:20], err: true},
+		{name: "v2 truncated tlv", in: proxyV2(ProxyProxy, 0x11, append(inet, tlv[:4]...)...), err: true},
+		{name: "no header", in: []byte("\x05\x01\x00"), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The header is read exactly, leaving what follows for the SOCKS handshake.
+			r := bytes.NewReader(append(append([]byte(nil), tt.in...), "rest"...))
+			if tt.err {
+				r = bytes.NewReader(tt.in)
+			}
+			h, err := readProxyHeader(r)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", h)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Command != tt.command {
+				t.Errorf("command %d, want %d", h.Command, tt.command)
+			}
+			var source string
+			if h.Source != nil {
+				source = h.Source.String()
+			}
+			if source != tt.source {
+				t.Errorf("source %q, want %q", source, tt.source)
+			}
+			if rest := make([]byte, 8); r.Len() != 4 {
+				n, _ := r.Read(rest)
+				t.Errorf("left %q, want %q", rest[:n], "rest")
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// minRateChunk and maxRateChunk bound how much a paced relay copies
+	// before paying for it, so that a changed rate is seen soon.
+	minRateChunk = 4 * 1024
+	maxRateChunk = 256 * 1024
+)
+
+// Bandwidth is a pair of rates in bytes per second.
+// Up is the rate from the client, Down the rate to it. Zero means no limit.
+type Bandwidth struct {
+	Up, Down int64
+}
+
+// RateLimits are the bandwidth limits of a user.
+type RateLimits struct {
+	// User is shared by all the sessions of the user.
+	User Bandwidth
+	// Session applies to each session on its own.
+	Session Bandwidth
+}
+
+// RateLimiter limits the bandwidth of the sessions relayed by a handler,
+// per session, per user and overall.
+// Sessions of clients which did not authenticate get the limits of the empty user name,
+// its User bandwidth being shared per source IP rather than by all of them.
+// Limits may be changed at any time, and apply to the sessions in progress.
+type RateLimiter struct {
+	mu         sync.Mutex
+	global     Bandwidth
+	globalUp   *bucket
+	globalDown *bucket
+	defaults   RateLimits
+	limits     map[string]RateLimits
+	users      map[rateKey]*userRate
+}
+
+// rateKey identifies the sessions sharing a user bandwidth:
+// those of a user, or those from a source IP for clients which did not authenticate.
+type rateKey struct {
+	user, ip string
+}
+
+// NewRateLimiter creates a rate limiter without any limit.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		globalUp:   newBucket(0),
+		globalDown: newBucket(0),
+		limits:     make(map[string]RateLimits),
+		users:      make(map[rateKey]*userRate),
+	}
+}
+
+// SetGlobal sets the bandwidth shared by all the sessions.
+func (l *RateLimiter) SetGlobal(bw Bandwidth) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.global = bw
+	l.globalUp.setRate(bw.Up)
+	l.globalDown.setRate(bw.Down)
+}
+
+// Global returns the bandwidth shared by all the sessions.
+func (l *RateLimiter) Global() Bandwidth {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.global
+}
+
+// SetDefault sets the limits of the users which have none of their own.
+func (l *RateLimiter) SetDefault(limits RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.defaults = limits
+	for key, u := range l.users {
+		if _, ok := l.limits[key.user]; !ok {
+			u.apply(limits)
+		}
+	}
+}
+
+// SetUser sets the limits of user.
+func (l *RateLimiter) SetUser(user string, limits RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits[user] = limits
+	l.apply(user, limits)
+}
+
+// RemoveUser removes the limits of user, who gets the default ones again.
+func (l *RateLimiter) RemoveUser(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.limits, user)
+	l.apply(user, l.defaults)
+}
+
+// Limits returns the limits which apply to user.
+func (l *RateLimiter) Limits(user string) RateLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limitsOf(user)
+}
+
+// apply changes the limits of the sessions of user in progress.
+func (l *RateLimiter) apply(user string, limits RateLimits) {
+	if user != "" {
+		if u := l.users[rateKey{user: user}]; u != nil {
+			u.apply(limits)
+		}
+		return
+	}
+	for key, u := range l.users {
+		if key.user == "" {
+			u.apply(limits)
+		}
+	}
+}
+
+func (l *RateLimiter) limitsOf(user string) RateLimits {
+	if limits, ok := l.limits[user]; ok {
+		return limits
+	}
+	return l.defaults
+}
+
+// open returns the rate of a new session of user from ip. It must be closed when the session ends.
+func (l *RateLimiter) open(user, ip string) *sessionRate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := rateKey{user: user}
+	if user == "" {
+		key.ip = ip
+	}
+	limits := l.limitsOf(user)
+	u := l.users[key]
+	if u == nil {
+		u = &userRate{
+			up:       newBucket(limits.User.Up),
+			down:     newBucket(limits.User.Down),
+			sessions: make(map[*sessionRate]struct{}),
+		}
+		l.users[key] = u
+	}
+	s := &sessionRate{
+		l:    l,
+		key:  key,
+		up:   newBucket(limits.Session.Up),
+		down: newBucket(limits.Session.Down),
+	}
+	s.upBuckets = []*bucket{s.up, u.up, l.globalUp}
+	s.downBuckets = []*bucket{s.down, u.down, l.globalDown}
+	u.sessions[s] = struct{}{}
+	return s
+}
+
+func (l *RateLimiter) close(s *sessionRate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u := l.users[s.key]
+	if u == nil {
+		return
+	}
+	delete(u.sessions, s)
+	if len(u.sessions) == 0 {
+		delete(l.users, s.key)
+	}
+}
+
+// userRate holds the buckets of a user, or of an anonymous source IP, with sessions in progress.
+type userRate struct {
+	up, down *bucket
+	sessions map[*sessionRate]struct{}
+}
+
+func (u *userRate) apply(limits RateLimits) {
+	u.up.setRate(limits.User.Up)
+	u.down.setRate(limits.User.Down)
+	for s := range u.sessions {
+		s.up.setRate(limits.Session.Up)
+		s.down.setRate(limits.Session.Down)
+	}
+}
+
+// sessionRate holds the buckets a session takes from in each direction:
+// its own, its user's and the global one.
+type sessionRate struct {
+	l                      *RateLimiter
+	key                    rateKey
+	up, down               *bucket
+	upBuckets, downBuckets []*bucket
+}
+
+func (s *sessionRate) close() {
+	s.l.close(s)
+}
+
+// bucket is a token bucket holding up to window of its rate.
+// Taking more tokens than there are leaves it in debt, which later takers wait for.
+type bucket struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	rate   int64 // tokens per second, zero for no limit
+	tokens float64
+	last   time.Time
+}
+
+// newBucket creates a bucket holding one second of rate.
+func newBucket(rate int64) *bucket {
+	return newBucketWindow(rate, time.Second)
+}
+
+func newBucketWindow(rate int64, window time.Duration) *bucket {
+	b := &bucket{
+		window: window,
+		rate:   rate,
+		last:   time.Now(),
+	}
+	b.tokens = b.size()
+	return b
+}
+
+// size is how many tokens the bucket holds when full.
+func (b *bucket) size() float64 {
+	return float64(b.rate) * b.window.Seconds()
+}
+
+func (b *bucket) getRate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rate
+}
+
+func (b *bucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A bucket without limit starts full, one with a limit keeps its tokens.
+	now := time.Now()
+	unlimited := b.rate <= 0
+	if !unlimited {
+		b.fill(now)
+	}
+	b.rate = rate
+	b.last = now
+	if size := b.size(); unlimited || b.tokens > size {
+		b.tokens = size
+	}
+}
+
+// take takes n tokens and returns how long until the bucket is out of debt.
+func (b *bucket) take(n int64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.fill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+func (b *bucket) fill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if size := b.size(); b.tokens > size {
+		b.tokens = size
+	}
+	b.last = now
+}
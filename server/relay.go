@@ -0,0 +1,400 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/ginuerzh/gosocks5/client"
+)
+
+const (
+	// maxIdleTick bounds how long a copy may run before reporting its progress
+	// when an idle timeout is set.
+	maxIdleTick = time.Second
+)
+
+var (
+	errIdleTimeout    = errors.New("relay: idle timeout")
+	errSessionTimeout = errors.New("relay: max session time exceeded")
+	errLingerTimeout  = errors.New("relay: linger timeout")
+	errRelayAborted   = errors.New("relay: aborted")
+)
+
+// buffer pools for relays which cannot splice.
+// A relay starts with a small buffer and moves to a large one once reads fill it.
+var (
+	smallBufPool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, 16*1024)
+		},
+	}
+	largeBufPool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, 256*1024)
+		},
+	}
+)
+
+// relay copies data between a client and a peer.
+type relay struct {
+	client, peer net.Conn
+	// tick is the read deadline of each copy, so that progress is seen while
+	// splicing. It is zero when there is no idle timeout.
+	tick time.Duration
+
+	last     int64 // time of the last progress, in nanoseconds
+	up, down int64
+
+	// upPace and downPace pace each direction, nil for no limit.
+	upPace, downPace *pacer
+
+	mu     sync.Mutex
+	reason error         // why the relay was stopped
+	done   chan struct{} // closed when the relay is stopped
+}
+
+// transport relays data between the client and the peer until both directions are done.
+//
+// When one direction reaches EOF, the write side of its destination is closed
+// and the other direction goes on until it ends too, or opts.LingerTimeout expires.
+// If either direction fails, or a destination cannot be half-closed, the relay stops.
+// With opts.IdleTimeout set, the relay also stops once no data has passed in either direction for that long,
+// and with opts.MaxSessionTime set, once the session has lasted that long.
+// The error of the stats tells which timeout fired.
+//
+// The connections are unwrapped down to the underlying ones first, so that
+// TCP to TCP relays use splice(2) where the system supports it.
+// A paced session is relayed in chunks, splicing each of them.
+func transport(client, peer net.Conn, sess *Session) *RelayStats {
+	opts := sess.opts
+	start := time.Now()
+	r := &relay{
+		client: unwrapConn(client),
+		peer:   unwrapConn(peer),
+		last:   start.UnixNano(),
+		done:   make(chan struct{}),
+	}
+	r.upPace, r.downPace = sess.pacers()
+	if opts.IdleTimeout > 0 {
+		r.tick = opts.IdleTimeout / 4
+		if r.tick > maxIdleTick {
+			r.tick = maxIdleTick
+		}
+	}
+
+	var upErr, downErr error
+	upc := make(chan error, 1)
+	downc := make(chan error, 1)
+	go func() {
+		upc <- r.pipe(r.peer, r.client, &r.up, r.upPace)
+	}()
+	go func() {
+		downc <- r.pipe(r.client, r.peer, &r.down, r.downPace)
+	}()
+
+	if opts.IdleTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go r.watch(opts.IdleTimeout, done)
+	}
+	if opts.MaxSessionTime > 0 {
+		begin := sess.Start
+		if begin.IsZero() {
+			begin = start
+		}
+		t := time.AfterFunc(time.Until(begin.Add(opts.MaxSessionTime)), func() {
+			r.stop(errSessionTimeout)
+		})
+		defer t.Stop()
+	}
+
+	// Wait for the first direction to end.
+	var rest chan error
+	var halfClosed bool
+	select {
+	case upErr = <-upc:
+		rest = downc
+		halfClosed = upErr == nil && closeWrite(r.peer)
+	case downErr = <-downc:
+		rest = upc
+		halfClosed = downErr == nil && closeWrite(r.client)
+	}
+
+	// Let the other one drain.
+	if !halfClosed {
+		r.stop(errRelayAborted)
+	}
+	var linger <-chan time.Time
+	if halfClosed && opts.LingerTimeout > 0 {
+		t := time.NewTimer(opts.LingerTimeout)
+		defer t.Stop()
+		linger = t.C
+	}
+	var err error
+	select {
+	case err = <-rest:
+	case <-linger:
+		r.stop(errLingerTimeout)
+		err = <-rest
+	}
+	if rest == downc {
+		downErr = err
+		if halfClosed {
+			closeWrite(r.client)
+		}
+	} else {
+		upErr = err
+		if halfClosed {
+			closeWrite(r.peer)
+		}
+	}
+
+	stats := &RelayStats{
+		Up:       atomic.LoadInt64(&r.up),
+		Down:     atomic.LoadInt64(&r.down),
+		UpErr:    upErr,
+		DownErr:  downErr,
+		Duration: time.Since(start),
+	}
+	for _, err := range []error{upErr, downErr} {
+		if err != nil && err != errRelayAborted {
+			stats.Err = err
+			break
+		}
+	}
+	return stats
+}
+
+// pipe copies from src to dst, counting the bytes in n and pacing them with p.
+// It returns nil when src reaches EOF, or the reason of the relay being stopped.
+func (r *relay) pipe(dst, src net.Conn, n *int64, p *pacer) error {
+	for {
+		if r.tick > 0 {
+			src.SetReadDeadline(time.Now().Add(r.tick))
+		}
+		var limit int64
+		if p != nil {
+			limit = p.chunk()
+		}
+		written, err := copyConn(dst, src, limit)
+		if written > 0 {
+			atomic.AddInt64(n, written)
+			atomic.StoreInt64(&r.last, time.Now().UnixNano())
+			if p != nil {
+				if !p.wait(written, r.done) {
+					return r.stopped()
+				}
+				// Waiting for the pace counts as progress, it does not make the relay idle.
+				atomic.StoreInt64(&r.last, time.Now().UnixNano())
+			}
+		}
+		if err == nil {
+			if limit > 0 && written == limit {
+				continue
+			}
+			return nil
+		}
+		if reason := r.stopped(); reason != nil {
+			return reason
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && r.tick > 0 {
+			continue
+		}
+		return err
+	}
+}
+
+// stop interrupts both directions, which then return reason.
+// Only the first reason is kept.
+func (r *relay) stop(reason error) {
+	r.mu.Lock()
+	if r.reason == nil {
+		r.reason = reason
+		close(r.done)
+	}
+	r.mu.Unlock()
+
+	r.client.SetDeadline(time.Unix(1, 0))
+	r.peer.SetDeadline(time.Unix(1, 0))
+}
+
+func (r *relay) stopped() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reason
+}
+
+// watch stops the relay once it has been idle for the timeout.
+// Progress is seen up to one tick late, so the check allows for it.
+func (r *relay) watch(idle time.Duration, done <-chan struct{}) {
+	t := time.NewTimer(idle)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		elapsed := time.Since(time.Unix(0, atomic.LoadInt64(&r.last)))
+		if elapsed < idle+r.tick {
+			t.Reset(idle + r.tick - elapsed)
+			continue
+		}
+		r.stop(errIdleTimeout)
+		return
+	}
+}
+
+// pacer paces one direction of a session with the buckets of its rate limits
+// and the queue of its scheduler class, either being optional.
+// The data is sent first, and paid for before sending more.
+type pacer struct {
+	buckets []*bucket
+	class   *drrClass
+}
+
+// pacers returns the pacers of the session, nil if it has no limit.
+func (s *Session) pacers() (up, down *pacer) {
+	if s.rate == nil && s.sched == nil {
+		return nil, nil
+	}
+	up, down = &pacer{}, &pacer{}
+	if s.rate != nil {
+		up.buckets = s.rate.upBuckets
+		down.buckets = s.rate.downBuckets
+	}
+	if s.sched != nil {
+		up.class = s.sched.up.classes[s.class]
+		down.class = s.sched.down.classes[s.class]
+	}
+	return up, down
+}
+
+// chunk returns how much to send at once, about a tenth of a second
+// at the lowest of the rates.
+func (p *pacer) chunk() int64 {
+	n := int64(maxRateChunk)
+	buckets := p.buckets
+	if p.class != nil {
+		buckets = append(buckets[:len(buckets):len(buckets)], p.class.d.link)
+	}
+	for _, b := range buckets {
+		if rate := b.getRate(); rate > 0 && rate/10 < n {
+			n = rate / 10
+		}
+	}
+	if n < minRateChunk {
+		n = minRateChunk
+	}
+	return n
+}
+
+// wait pays for n bytes sent, waiting for the buckets to be out of debt
+// and then for the turn of the class.
+// It reports false if done is closed first.
+func (p *pacer) wait(n int64, done <-chan struct{}) bool {
+	var delay time.Duration
+	for _, b := range p.buckets {
+		if d := b.take(n); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-done:
+			return false
+		}
+	}
+	if p.class != nil {
+		return p.class.wait(n, done)
+	}
+	return true
+}
+
+// closeWrite shuts down the writing side of conn, reporting whether it could.
+func closeWrite(conn net.Conn) bool {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
+
+// copyConn copies from src to dst until EOF or an error, or limit bytes if limit is positive.
+// Between two TCP connections io.Copy splices, otherwise the data goes through a pooled buffer.
+func copyConn(dst, src net.Conn, limit int64) (int64, error) {
+	var r io.Reader = src
+	if limit > 0 {
+		r = &io.LimitedReader{R: src, N: limit}
+	}
+	_, srcTCP := src.(*net.TCPConn)
+	_, dstTCP := dst.(*net.TCPConn)
+	if srcTCP && dstTCP {
+		return io.Copy(dst, r)
+	}
+	return copyBuffer(dst, r)
+}
+
+// copyBuffer is like io.CopyBuffer with a buffer from the pools,
+// growing it once a read fills it.
+func copyBuffer(dst io.Writer, src io.Reader) (written int64, err error) {
+	buf := smallBufPool.Get().([]byte)
+	pool := &smallBufPool
+	defer func() {
+		pool.Put(buf)
+	}()
+
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				er = nil
+			}
+			return written, er
+		}
+		if nr == len(buf) && pool == &smallBufPool {
+			pool.Put(buf)
+			buf, pool = largeBufPool.Get().([]byte), &largeBufPool
+		}
+	}
+}
+
+// unwrapConn returns the connection underneath the wrappers which have
+// nothing left to do once the handshake is done.
+// Only the wrappers of this module are removed: a *gosocks5.Conn or a *client.Conn
+// gives way to the connection its selector returned, which is kept as it is
+// if the selector encapsulates the traffic, with TLS for example.
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *sessionConn:
+			conn = c.Conn
+		case *authConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		case *gosocks5.Conn:
+			conn = c.NetConn()
+		case *client.Conn:
+			conn = c.NetConn()
+		default:
+			return conn
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		tb.Fatal("accept failed")
+	}
+	return conn, peer
+}
+
+// benchmarkRelay relays b.N megabytes from a client to a peer over loopback,
+// reporting the CPU time of the process per megabyte as cpu-ns/op. With buffered set, the connections are hidden behind a wrapper
+// so that the relay cannot splice and copies through its buffers.
+func benchmarkRelay(b *testing.B, buffered bool) {
+	client, clientSide := tcpPair(b)
+	peerSide, peer := tcpPair(b)
+
+	var c, p net.Conn = clientSide, peerSide
+	if buffered {
+		c, p = struct{ net.Conn }{clientSide}, struct{ net.Conn }{peerSide}
+	}
+	relayed := make(chan struct{})
+	go func() {
+		transport(c, p, &Session{opts: &ServerOptions{}})
+		clientSide.Close()
+		peerSide.Close()
+		close(relayed)
+	}()
+
+	buf := make([]byte, 1<<20)
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.CopyN(ioutil.Discard, peer, int64(b.N)*int64(len(buf)))
+		received <- n
+	}()
+
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	cpu := cpuTime()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if n := <-received; n != int64(b.N)*int64(len(buf)) {
+		b.Fatalf("received %d bytes", n)
+	}
+	b.StopTimer()
+	if cpu := cpuTime() - cpu; cpu > 0 {
+		b.ReportMetric(float64(cpu.Nanoseconds())/float64(b.N), "cpu-ns/op")
+	}
+
+	client.Close()
+	peer.Close()
+	<-relayed
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, false)
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkRelay(b, true)
+}
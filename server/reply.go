@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// replyCode maps the error of a failed request to the REP field of the reply reporting it.
+func replyCode(err error) uint8 {
+	switch {
+	case errors.Is(err, errNotAllowed),
+		errors.Is(err, syscall.EACCES),
+		errors.Is(err, syscall.EPERM):
+		return gosocks5.NotAllowed
+	case errors.Is(err, gosocks5.ErrBadAddrType):
+		return gosocks5.AddrUnsupported
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return gosocks5.ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return gosocks5.NetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return gosocks5.HostUnreachable
+	}
+
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return gosocks5.NotAllowed
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return gosocks5.HostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return gosocks5.TTLExpired
+	}
+	return gosocks5.Failure
+}
+
+// reply sends a reply to the client of the session.
+func (s *Session) reply(conn net.Conn, rep uint8, addr *gosocks5.Addr) error {
+	err := gosocks5.NewReply(rep, addr).Write(conn)
+	s.onReply(rep)
+	return err
+}
+
+// replyError sends the reply reporting err to the client of the session, and returns err.
+func (s *Session) replyError(conn net.Conn, err error) error {
+	s.reply(conn, replyCode(err), nil)
+	return err
+}
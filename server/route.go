@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/ginuerzh/gosocks5/client"
+)
+
+var (
+	// DirectEgress connects to the destination directly, using the default route and source address.
+	DirectEgress = &Egress{Name: "direct"}
+)
+
+// Egress describes how outbound connections leave the server.
+type Egress struct {
+	// Name identifies the egress in logs.
+	Name string
+	// LocalIP is the source address for outbound connections, or nil for the system default.
+	// Destinations of the other family use the system default.
+	LocalIP net.IP
+	// Sources is a pool of source addresses, overriding LocalIP.
+	// Each connection uses one in the family of its destination, in turn,
+	// or the system default if the pool has none in that family.
+	Sources []net.IP
+	// SourceByUser makes the sessions of a user always use the same address of Sources,
+	// so that the user keeps a stable egress address.
+	SourceByUser bool
+	// Proxy is the address of an upstream SOCKS5 server to connect through, or empty to connect directly.
+	Proxy string
+	// ProxyUser is the optional username/password for the upstream proxy.
+	ProxyUser *url.Userinfo
+	// ProxyProtocol is the version of the PROXY protocol header, 1 or 2,
+	// sent to the destination of CONNECT requests to give it the address of the client.
+	// Zero sends none.
+	ProxyProtocol int
+	// ProxyProtocolTLVs adds the user name and the session ID to version 2 headers,
+	// as ProxyTLVUser and ProxyTLVUniqueID fields.
+	ProxyProtocolTLVs bool
+
+	next uint32 // the next source, for round robin
+}
+
+func (e *Egress) String() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	switch {
+	case e.Proxy != "":
+		return "proxy " + e.Proxy
+	case e.LocalIP != nil:
+		return "source " + e.LocalIP.String()
+	}
+	return "direct"
+}
+
+// Dial connects to addr through the egress.
+func (e *Egress) Dial(network, addr string) (net.Conn, error) {
+	return e.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the egress using the provided context.
+// The user of the session carried by ctx, if any, picks the source address when SourceByUser is set.
+func (e *Egress) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	target := addr
+	if e.Proxy != "" {
+		target = e.Proxy
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil || !e.mixedSources() {
+		return e.dial(ctx, network, addr, target, ip)
+	}
+	// The family of the source depends on the address the name resolves to.
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ipAddr := range ipAddrs {
+		var conn net.Conn
+		conn, err = e.dial(ctx, network, addr, net.JoinHostPort(ipAddr.IP.String(), port), ipAddr.IP)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, err
+}
+
+// dial connects to addr through the egress, reaching the upstream proxy or the destination at target.
+// ip is the address of target, nil if it is a name.
+func (e *Egress) dial(ctx context.Context, network, addr, target string, ip net.IP) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if src := e.source(ctx, ip); src != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	if e.Proxy == "" {
+		return dialer.DialContext(ctx, network, target)
+	}
+
+	methods := []uint8{gosocks5.MethodNoAuth}
+	if e.ProxyUser != nil {
+		methods = append(methods, gosocks5.MethodUserPass)
+	}
+	d := &client.Dialer{
+		ProxyAddr: target,
+		Selector:  client.NewClientSelector(e.ProxyUser, methods...),
+		Forward:   dialer,
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// source returns the source address for a connection to ip, nil for the system default.
+// It is in the family of ip, any family if ip is nil.
+func (e *Egress) source(ctx context.Context, ip net.IP) net.IP {
+	if len(e.Sources) == 0 {
+		if ip != nil && e.LocalIP != nil && (e.LocalIP.To4() != nil) != (ip.To4() != nil) {
+			return nil
+		}
+		return e.LocalIP
+	}
+
+	var candidates []net.IP
+	for _, src := range e.Sources {
+		if ip == nil || (src.To4() != nil) == (ip.To4() != nil) {
+			candidates = append(candidates, src)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var i uint32
+	if sess := SessionFromContext(ctx); e.SourceByUser && sess != nil && sess.User != "" {
+		h := fnv.New32a()
+		h.Write([]byte(sess.User))
+		i = h.Sum32()
+	} else {
+		i = atomic.AddUint32(&e.next, 1) - 1
+	}
+	return candidates[i%uint32(len(candidates))]
+}
+
+// mixedSources reports whether Sources has addresses of both families.
+func (e *Egress) mixedSources() bool {
+	var v4, v6 bool
+	for _, src := range e.Sources {
+		if src.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	return v4 && v6
+}
+
+// listenUDP opens the sockets sending the datagrams of a UDP association to IPv4 and IPv6 destinations.
+// A family with a source address gets its own socket bound to it, the others share an unbound one.
+func (e *Egress) listenUDP(ctx context.Context) (v4, v6 *net.UDPConn, err error) {
+	if src := e.source(ctx, net.IPv4zero); src != nil {
+		if v4, err = net.ListenUDP("udp4", &net.UDPAddr{IP: src}); err != nil {
+			return nil, nil, err
+		}
+	}
+	if src := e.source(ctx, net.IPv6zero); src != nil {
+		if v6, err = net.ListenUDP("udp6", &net.UDPAddr{IP: src}); err != nil {
+			closeUDP(v4)
+			return nil, nil, err
+		}
+	}
+	if v4 != nil && v6 != nil {
+		return v4, v6, nil
+	}
+
+	shared, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		closeUDP(v4)
+		closeUDP(v6)
+		return nil, nil, err
+	}
+	if v4 == nil {
+		v4 = shared
+	}
+	if v6 == nil {
+		v6 = shared
+	}
+	return v4, v6, nil
+}
+
+func closeUDP(conn *net.UDPConn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Rule selects an egress for the requests it matches.
+// Empty fields match anything, a request must match all of the non-empty ones.
+type Rule struct {
+	// Users are the authenticated user names the rule applies to.
+	Users []string
+	// Sources are the client networks the rule applies to.
+	Sources []*net.IPNet
+	// Domains are destination domains the rule applies to, subdomains included.
+	Domains []string
+	// Networks are destination networks the rule applies to.
+	// The handler matches a destination name on the addresses it resolves to.
+	// A request matches the destination if it matches either Domains or Networks.
+	Networks []*net.IPNet
+	// Egress is used for the matched requests.
+	Egress *Egress
+}
+
+// Match reports whether the rule applies to a request for dst from user at src.
+// A destination name does not match Networks, see Router.
+func (r *Rule) Match(user string, src net.Addr, dst *gosocks5.Addr) bool {
+	return r.match(user, src, dst, net.ParseIP(dst.Host))
+}
+
+// match is Match for dst at ip, nil if unknown.
+func (r *Rule) match(user string, src net.Addr, dst *gosocks5.Addr, ip net.IP) bool {
+	if len(r.Users) > 0 && !matchUser(r.Users, user) {
+		return false
+	}
+	if len(r.Sources) > 0 && !matchIP(r.Sources, addrIP(src)) {
+		return false
+	}
+	if len(r.Domains) > 0 || len(r.Networks) > 0 {
+		if !matchDomain(r.Domains, dst.Host) && !matchIP(r.Networks, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Router picks the egress for each CONNECT request.
+// The first matching rule wins, requests matching no rule use Default.
+type Router struct {
+	Rules []*Rule
+	// Default is used when no rule matches, DirectEgress if nil.
+	Default *Egress
+	// Logger receives one line per routing decision, the standard logger if nil.
+	Logger *log.Logger
+}
+
+// Route returns the egress for a request for dst from user at src.
+// A destination name does not match the Networks of the rules: the handler
+// resolves it first if a rule has Networks, and routes each address on its own.
+func (r *Router) Route(user string, src net.Addr, dst *gosocks5.Addr) *Egress {
+	if dst == nil {
+		dst = &gosocks5.Addr{}
+	}
+	return r.route(user, src, dst, net.ParseIP(dst.Host))
+}
+
+// route is Route for dst at ip, nil if unknown.
+func (r *Router) route(user string, src net.Addr, dst *gosocks5.Addr, ip net.IP) *Egress {
+	to := dst.String()
+	if ip != nil && dst.Type == gosocks5.AddrDomain {
+		to += " ip=" + ip.String()
+	}
+	for i, rule := range r.Rules {
+		if rule.Egress != nil && rule.match(user, src, dst, ip) {
+			r.logf("route: user=%q src=%s dst=%s rule=%d egress=%s", user, src, to, i, rule.Egress)
+			return rule.Egress
+		}
+	}
+
+	egress := r.Default
+	if egress == nil {
+		egress = DirectEgress
+	}
+	r.logf("route: user=%q src=%s dst=%s rule=default egress=%s", user, src, to, egress)
+	return egress
+}
+
+// matchesNetworks reports whether a rule has destination networks,
+// for which destination names must be resolved.
+func (r *Router) matchesNetworks() bool {
+	for _, rule := range r.Rules {
+		if len(rule.Networks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) logf(format string, v ...interface{}) {
+	if r.Logger != nil {
+		r.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// ParseCIDRs parses a list of CIDR strings, as used by Rule.Sources and Rule.Networks.
+// A bare IP address is taken as a single-host network.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid IP address: " + s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func matchUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func matchIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(domains []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range domains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
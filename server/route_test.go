@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// staticResolver resolves every name to its addresses.
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, ip := range r {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+func TestRouteResolvedNetworks(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sources := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			sources <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	nets, _ := ParseCIDRs("127.0.0.0/8")
+	quiet := log.New(ioutil.Discard, "", 0)
+	router := &Router{
+		Rules:  []*Rule{{Networks: nets, Egress: &Egress{Name: "loopback", LocalIP: net.IPv4(127, 0, 0, 2)}}},
+		Logger: quiet,
+	}
+	h := NewHandler(
+		RouterHandlerOption(router),
+		ResolverHandlerOption(staticResolver{net.IPv4(127, 0, 0, 1)}),
+		LoggerHandlerOption(quiet),
+	)
+
+	client, conn := tcpPair(t)
+	defer client.Close()
+	go func() {
+		h.Handle(conn)
+		conn.Close()
+	}()
+	cc := gosocks5.ClientConn(client, nil)
+	if _, err := cc.Write(encodeRequest(t, gosocks5.CmdConnect, "example.test:"+port)); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := gosocks5.ReadReply(cc); err != nil || reply.Rep != gosocks5.Succeeded {
+		t.Fatal(reply, err)
+	}
+	if src := <-sources; src != "127.0.0.2" {
+		t.Errorf("connected from %s, want the loopback egress", src)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// drrQuantum is how many bytes a class of weight 1 may send per round.
+	drrQuantum = 16 * 1024
+	// drrWindow is the burst of the link, kept short so that the classes
+	// contend as soon as the link is busy.
+	drrWindow = 100 * time.Millisecond
+
+	// DefaultClass is the name of the class of the sessions no class matches.
+	DefaultClass = "default"
+)
+
+// TrafficClass is a class of sessions sharing the bandwidth of a scheduler.
+type TrafficClass struct {
+	Name string
+	// Weight is the share of the class relative to the other ones, 1 if less.
+	Weight int
+	// Users are the users whose sessions are in the class.
+	Users []string
+	// Ports are the destination ports whose sessions are in the class.
+	Ports []uint16
+}
+
+func (c *TrafficClass) match(user string, port uint16) bool {
+	for _, u := range c.Users {
+		if u == user {
+			return true
+		}
+	}
+	for _, p := range c.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Scheduler shares the bandwidth of the server among classes of sessions
+// in proportion to their weights, with deficit round robin.
+// The rate should be set a bit below the bandwidth of the uplink,
+// so that the scheduler rather than the network decides what waits.
+// Sessions are assigned to the first class with their user or destination port,
+// or to the DefaultClass of weight 1.
+type Scheduler struct {
+	classes  []*TrafficClass
+	up, down *drr
+}
+
+// NewScheduler creates a scheduler of the given bandwidth for the classes.
+func NewScheduler(bw Bandwidth, classes ...*TrafficClass) *Scheduler {
+	s := &Scheduler{
+		classes: classes,
+		up:      newDRR(bw.Up),
+		down:    newDRR(bw.Down),
+	}
+	for _, c := range classes {
+		s.up.addClass(c.Name, c.Weight)
+		s.down.addClass(c.Name, c.Weight)
+	}
+	s.up.addClass(DefaultClass, 1)
+	s.down.addClass(DefaultClass, 1)
+	return s
+}
+
+// SetRate changes the bandwidth shared by the classes.
+func (s *Scheduler) SetRate(bw Bandwidth) {
+	s.up.link.setRate(bw.Up)
+	s.down.link.setRate(bw.Down)
+}
+
+// Classify returns the name of the class of a session of user to port.
+func (s *Scheduler) Classify(user string, port uint16) string {
+	for _, c := range s.classes {
+		if c.match(user, port) {
+			return c.Name
+		}
+	}
+	return DefaultClass
+}
+
+// drr paces one direction of the relays at the rate of its link,
+// serving the queues of its classes with deficit round robin.
+type drr struct {
+	link *bucket
+
+	mu      sync.Mutex
+	classes map[string]*drrClass
+	active  []*drrClass // classes with queued requests, in round robin order
+	running bool
+}
+
+type drrClass struct {
+	d       *drr
+	weight  int64
+	deficit int64
+	queue   []*drrRequest
+	active  bool // whether the class is in the active list or being served
+}
+
+type drrRequest struct {
+	n        int64
+	ready    chan struct{}
+	canceled bool
+}
+
+func newDRR(rate int64) *drr {
+	return &drr{
+		link:    newBucketWindow(rate, drrWindow),
+		classes: make(map[string]*drrClass),
+	}
+}
+
+func (d *drr) addClass(name string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	if _, ok := d.classes[name]; !ok {
+		d.classes[name] = &drrClass{d: d, weight: int64(weight)}
+	}
+}
+
+// wait queues n bytes sent by a session of the class, and waits for their turn.
+// It reports false if done is closed first.
+func (c *drrClass) wait(n int64, done <-chan struct{}) bool {
+	req := &drrRequest{n: n, ready: make(chan struct{})}
+	d := c.d
+
+	d.mu.Lock()
+	if !c.active {
+		c.active = true
+		d.active = append(d.active, c)
+	}
+	c.queue = append(c.queue, req)
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-req.ready:
+		return true
+	case <-done:
+		d.mu.Lock()
+		req.canceled = true
+		d.mu.Unlock()
+		return false
+	}
+}
+
+// run serves the active classes until none has requests left.
+func (d *drr) run() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for len(d.active) > 0 {
+		c := d.active[0]
+		d.active = d.active[1:]
+		c.deficit += drrQuantum * c.weight
+		for len(c.queue) > 0 && c.queue[0].n <= c.deficit {
+			req := c.queue[0]
+			c.queue = c.queue[1:]
+			if req.canceled {
+				continue
+			}
+			c.deficit -= req.n
+
+			d.mu.Unlock()
+			if delay := d.link.take(req.n); delay > 0 {
+				time.Sleep(delay)
+			}
+			close(req.ready)
+			d.mu.Lock()
+		}
+		if len(c.queue) == 0 {
+			c.deficit = 0
+			c.active = false
+			continue
+		}
+		d.active = append(d.active, c)
+	}
+	d.running = false
+}
@@ -52,6 +52,11 @@ func (selector *serverSelector) OnSelected(method uint8, conn net.Conn) (net.Con
 			return nil, err
 		}
 
+		// A guarded client may be refused before its credentials are checked.
+		if a, ok := conn.(AuthAttempt); ok {
+			err = a.Attempt(req.Username)
+		}
+
 		valid := false
 		for _, user := range selector.users {
 			username := user.Username()
@@ -63,18 +68,22 @@ func (selector *serverSelector) OnSelected(method uint8, conn net.Conn) (net.Con
 				break
 			}
 		}
-		if len(selector.users) > 0 && !valid {
+		if err == nil && len(selector.users) > 0 && !valid {
+			err = gosocks5.ErrAuthFailure
+		}
+		if err != nil {
 			resp := gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Failure)
 			if err := resp.Write(conn); err != nil {
 				return nil, err
 			}
-			return nil, gosocks5.ErrAuthFailure
+			return nil, err
 		}
 
 		resp := gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Succeeded)
 		if err := resp.Write(conn); err != nil {
 			return nil, err
 		}
+		return gosocks5.WithIdentity(conn, &gosocks5.Identity{User: req.Username}), nil
 	case gosocks5.MethodNoAcceptable:
 		return nil, gosocks5.ErrBadMethod
 	}
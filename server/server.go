@@ -1,13 +1,31 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	shutdownPollInterval = 50 * time.Millisecond
+)
+
+var (
+	// ErrServerClosed is returned by Serve after a call to Shutdown or Close.
+	ErrServerClosed = errors.New("server: Server closed")
+)
+
 // Server is a SOCKS5 server.
 type Server struct {
 	Listener net.Listener
+
+	mu       sync.Mutex
+	sessions map[net.Conn]struct{}
+	closed   int32
 }
 
 // Addr returns the address of the server
@@ -28,11 +46,34 @@ func (s *Server) Serve(h Handler, options ...ServerOption) error {
 		h = DefaultHandler
 	}
 
+	opts := &ServerOptions{}
+	for _, o := range options {
+		o(opts)
+	}
+
+	var sem chan struct{}
+	if opts.MaxSessions > 0 {
+		sem = make(chan struct{}, opts.MaxSessions)
+	}
+	var trusted *IPFilter
+	if len(opts.ProxyProtocol) > 0 {
+		trusted = NewIPFilter(opts.ProxyProtocol, nil)
+	}
+
 	l := s.Listener
 	var tempDelay time.Duration
 	for {
+		if sem != nil {
+			sem <- struct{}{}
+		}
 		conn, e := l.Accept()
 		if e != nil {
+			if sem != nil {
+				<-sem
+			}
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -49,18 +90,228 @@ func (s *Server) Serve(h Handler, options ...ServerOption) error {
 		}
 		tempDelay = 0
 
-		go h.Handle(conn)
+		// Connections from a trusted proxy are filtered on the address of the client, once known.
+		proxied := trusted != nil && trusted.Allow(addrIP(conn.RemoteAddr()))
+		if !proxied && opts.Filter != nil && !opts.Filter.Allow(addrIP(conn.RemoteAddr())) {
+			conn.Close()
+			if sem != nil {
+				<-sem
+			}
+			continue
+		}
+		if !s.trackSession(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer func() {
+				if sem != nil {
+					<-sem
+				}
+			}()
+			defer s.trackSession(conn, false)
+			defer conn.Close()
+
+			c := conn
+			var header *ProxyHeader
+			if proxied {
+				var err error
+				if c, header, err = acceptProxy(conn, opts.HandshakeTimeout); err != nil {
+					opts.logf("server: %s: %v", conn.RemoteAddr(), err)
+					return
+				}
+				// Without the address of a client, the connection is the proxy's own.
+				if c != conn && opts.Filter != nil && !opts.Filter.Allow(addrIP(c.RemoteAddr())) {
+					return
+				}
+			}
+
+			sess := newSession(c, opts)
+			sess.ProxyHeader = header
+			if err := h.Handle(&sessionConn{Conn: c, sess: sess}); err != nil {
+				opts.logf("server: %s: %v", c.RemoteAddr(), err)
+			}
+		}()
 	}
 }
 
 // Close closes the socks5 server
 func (s *Server) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
 	return s.Listener.Close()
 }
 
+// Shutdown gracefully shuts down the server: it stops accepting connections,
+// then waits for the active sessions to finish.
+// If ctx is done before they have, the remaining sessions are closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.ActiveSessions() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ActiveSessions returns the number of client connections being served.
+func (s *Server) ActiveSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sessions)
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.closed) != 0
+}
+
+// trackSession adds or removes conn from the active sessions.
+// It reports false if conn cannot be added because the server is shutting down.
+func (s *Server) trackSession(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.sessions, conn)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[net.Conn]struct{})
+	}
+	s.sessions[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) closeSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.sessions {
+		conn.Close()
+	}
+}
+
 // ServerOptions is options for server.
+// Zero values mean no limit.
 type ServerOptions struct {
+	// HandshakeTimeout limits the method negotiation, including sub-negotiation.
+	HandshakeTimeout time.Duration
+	// ReadTimeout limits reading the request once the handshake is done.
+	ReadTimeout time.Duration
+	// DialTimeout limits connecting to the destination.
+	DialTimeout time.Duration
+	// IdleTimeout closes a relayed session when no data has passed for this long.
+	IdleTimeout time.Duration
+	// LingerTimeout limits how long a relay goes on in one direction
+	// once the other has been half-closed.
+	LingerTimeout time.Duration
+	// MaxSessionTime limits the lifetime of a session, enforced by the relay.
+	MaxSessionTime time.Duration
+	// MaxSessions limits the number of concurrent sessions.
+	// The server stops accepting connections while the limit is reached.
+	MaxSessions int
+	// Filter decides which source addresses may connect.
+	// Connections from other addresses are closed as soon as they are accepted.
+	// Connections from a trusted proxy are filtered on the client address of their PROXY protocol header,
+	// and let through if it has none.
+	Filter *IPFilter
+	// ProxyProtocol are the networks of the trusted proxies, such as load balancers.
+	// Connections from them must start with a PROXY protocol header of version 1 or 2,
+	// giving the address of the client. It is read within HandshakeTimeout, or ten seconds if zero.
+	ProxyProtocol []*net.IPNet
+	// ErrorLog receives the errors of the sessions, the standard logger if nil.
+	ErrorLog *log.Logger
+}
+
+func (opts *ServerOptions) logf(format string, v ...interface{}) {
+	if opts.ErrorLog != nil {
+		opts.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
 }
 
 // ServerOption allows a common way to set server options.
 type ServerOption func(opts *ServerOptions)
+
+// HandshakeTimeoutServerOption sets the timeout of the method negotiation.
+func HandshakeTimeoutServerOption(timeout time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.HandshakeTimeout = timeout
+	}
+}
+
+// ReadTimeoutServerOption sets the timeout for reading the request.
+func ReadTimeoutServerOption(timeout time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.ReadTimeout = timeout
+	}
+}
+
+// DialTimeoutServerOption sets the timeout for connecting to the destination.
+func DialTimeoutServerOption(timeout time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.DialTimeout = timeout
+	}
+}
+
+// IdleTimeoutServerOption sets the idle timeout of relayed sessions.
+func IdleTimeoutServerOption(timeout time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.IdleTimeout = timeout
+	}
+}
+
+// LingerTimeoutServerOption sets how long a half-closed relay may go on.
+func LingerTimeoutServerOption(timeout time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.LingerTimeout = timeout
+	}
+}
+
+// MaxSessionTimeServerOption sets the maximum lifetime of a session.
+func MaxSessionTimeServerOption(d time.Duration) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.MaxSessionTime = d
+	}
+}
+
+// MaxSessionsServerOption sets the maximum number of concurrent sessions.
+func MaxSessionsServerOption(n int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.MaxSessions = n
+	}
+}
+
+// FilterServerOption sets the filter of the source addresses.
+func FilterServerOption(filter *IPFilter) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.Filter = filter
+	}
+}
+
+// ProxyProtocolServerOption sets the networks of the trusted proxies sending a PROXY protocol header.
+func ProxyProtocolServerOption(trusted ...*net.IPNet) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.ProxyProtocol = trusted
+	}
+}
+
+// ErrorLogServerOption sets the logger for session errors.
+func ErrorLogServerOption(logger *log.Logger) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.ErrorLog = logger
+	}
+}
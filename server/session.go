@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+type sessionKey struct{}
+
+// Session describes a client connection being served.
+// The handler fills in the fields as the session progresses.
+type Session struct {
+	// ID identifies the session in logs.
+	ID string
+	// RemoteAddr is the address of the client.
+	// Behind a trusted proxy, it is the one the PROXY protocol header gives.
+	RemoteAddr net.Addr
+	// ProxyHeader is the PROXY protocol header the connection started with, if any.
+	ProxyHeader *ProxyHeader
+	// Start is when the connection was accepted.
+	Start time.Time
+	// Method is the negotiated method.
+	Method uint8
+	// User is the name the client authenticated with, empty if it did not.
+	User string
+	// Identity is what the selector attached to the connection in OnSelected, nil if nothing.
+	// The context of the session carries it too, see gosocks5.IdentityFromContext.
+	Identity *gosocks5.Identity
+	// Request is the request of the client.
+	Request *gosocks5.Request
+
+	ctx   context.Context
+	opts  *ServerOptions
+	hooks []*Hooks
+	rate  *sessionRate // bandwidth limits of the relay, nil for none
+	sched *Scheduler   // scheduler of the relay, nil for none
+	class string       // class of the session in sched
+}
+
+func newSession(conn net.Conn, opts *ServerOptions) *Session {
+	if opts == nil {
+		opts = &ServerOptions{}
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	s := &Session{
+		ID:         hex.EncodeToString(b),
+		RemoteAddr: conn.RemoteAddr(),
+		Start:      time.Now(),
+		Method:     gosocks5.MethodNoAcceptable,
+		opts:       opts,
+	}
+	s.ctx = contextWithSession(context.Background(), s)
+	return s
+}
+
+// Options returns the options of the server which accepted the connection.
+func (s *Session) Options() *ServerOptions {
+	return s.opts
+}
+
+// Context returns the context of the session, carrying the session itself.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// SessionFromContext returns the session carried by ctx, or nil.
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+func contextWithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// identify records the identity of the client, once authenticated.
+func (s *Session) identify(id *gosocks5.Identity) {
+	s.Identity = id
+	s.ctx = gosocks5.NewIdentityContext(s.ctx, id)
+}
+
+// sessionOf returns the session carried by ctx, or an empty one
+// when a command handler is called outside of the handler.
+func sessionOf(ctx context.Context) *Session {
+	if s := SessionFromContext(ctx); s != nil {
+		return s
+	}
+	return &Session{opts: &ServerOptions{}, ctx: ctx}
+}
+
+// sessionConn carries the session of a connection from the server,
+// through the middlewares, to the handler.
+type sessionConn struct {
+	net.Conn
+	sess *Session
+}
+
+// Session returns the session of the connection.
+func (c *sessionConn) Session() *Session {
+	return c.sess
+}
+
+// withSession returns conn carrying a session: the one of the connection conn wraps,
+// or a new one if conn did not come from the server or a middleware.
+func withSession(conn net.Conn) *sessionConn {
+	if sc, ok := conn.(*sessionConn); ok {
+		return sc
+	}
+	sess := findSession(conn)
+	if sess == nil {
+		sess = newSession(conn, nil)
+	}
+	return &sessionConn{
+		Conn: conn,
+		sess: sess,
+	}
+}
+
+// findSession returns the session of the connection underneath the wrappers of conn,
+// unwrapped with their NetConn method, or nil.
+func findSession(conn net.Conn) *Session {
+	for {
+		switch c := conn.(type) {
+		case interface{ Session() *Session }:
+			return c.Session()
+		case interface{ NetConn() net.Conn }:
+			next := c.NetConn()
+			if next == nil || next == conn {
+				return nil
+			}
+			conn = next
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *Session) onMethod(method uint8) {
+	s.Method = method
+	for _, h := range s.hooks {
+		if h.OnMethod != nil {
+			h.OnMethod(s.ctx, method)
+		}
+	}
+}
+
+func (s *Session) onAuth(user string) {
+	s.User = user
+	for _, h := range s.hooks {
+		if h.OnAuth != nil {
+			h.OnAuth(s.ctx, user)
+		}
+	}
+}
+
+func (s *Session) onAuthFail(method uint8, user string, err error) {
+	for _, h := range s.hooks {
+		if h.OnAuthFail != nil {
+			h.OnAuthFail(s.ctx, method, user, err)
+		}
+	}
+}
+
+func (s *Session) onLockout(lockout *Lockout) {
+	for _, h := range s.hooks {
+		if h.OnLockout != nil {
+			h.OnLockout(s.ctx, lockout)
+		}
+	}
+}
+
+func (s *Session) onRequest(req *gosocks5.Request) {
+	s.Request = req
+	for _, h := range s.hooks {
+		if h.OnRequest != nil {
+			h.OnRequest(s.ctx, req)
+		}
+	}
+}
+
+func (s *Session) onReply(rep uint8) {
+	for _, h := range s.hooks {
+		if h.OnReply != nil {
+			h.OnReply(s.ctx, rep)
+		}
+	}
+}
+
+func (s *Session) onDial(dst *gosocks5.Addr, d time.Duration, err error) {
+	for _, h := range s.hooks {
+		if h.OnDial != nil {
+			h.OnDial(s.ctx, dst, d, err)
+		}
+	}
+}
+
+func (s *Session) onConnect(upstream net.Conn) {
+	for _, h := range s.hooks {
+		if h.OnConnect != nil {
+			h.OnConnect(s.ctx, upstream)
+		}
+	}
+}
+
+func (s *Session) onRelayDone(stats *RelayStats) {
+	for _, h := range s.hooks {
+		if h.OnRelayDone != nil {
+			h.OnRelayDone(s.ctx, stats)
+		}
+	}
+}
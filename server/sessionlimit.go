@@ -0,0 +1,185 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// sessionLimitSweep is how often idle entries are dropped from a SessionLimiter.
+const sessionLimitSweep = time.Minute
+
+// Reasons of a LimitError.
+const (
+	LimitIPSessions   = "ip_sessions"
+	LimitIPRate       = "ip_rate"
+	LimitUserSessions = "user_sessions"
+	LimitUserRate     = "user_rate"
+)
+
+// LimitError reports a session rejected by a SessionLimiter.
+// A client over the limits of its source IP gets no acceptable method,
+// one over the limits of its user a NotAllowed reply.
+type LimitError struct {
+	// Reason is which limit was exceeded, one of the Limit constants.
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return "session limit exceeded: " + e.Reason
+}
+
+// SessionLimit limits the sessions of a source IP or of a user.
+type SessionLimit struct {
+	// MaxSessions is the maximum number of concurrent sessions, unlimited if zero.
+	MaxSessions int
+	// Rate is the maximum number of new sessions per second, unlimited if zero.
+	Rate float64
+	// Burst is how many new sessions may start at once above the rate, at least 1.
+	Burst int
+}
+
+// SessionLimiter limits the sessions per source IP and per authenticated user.
+// Source IPs are counted from the accept and refused at method selection,
+// before authenticating, users are counted from the request.
+type SessionLimiter struct {
+	mu        sync.Mutex
+	perIP     SessionLimit
+	perUser   SessionLimit
+	ips       map[string]*sessionCount
+	users     map[string]*sessionCount
+	lastSweep time.Time
+}
+
+// NewSessionLimiter creates a session limiter with the limits of each source IP and each user.
+func NewSessionLimiter(perIP, perUser SessionLimit) *SessionLimiter {
+	return &SessionLimiter{
+		perIP:     perIP,
+		perUser:   perUser,
+		ips:       make(map[string]*sessionCount),
+		users:     make(map[string]*sessionCount),
+		lastSweep: time.Now(),
+	}
+}
+
+// SetLimits changes the limits. Sessions in progress are not affected.
+func (l *SessionLimiter) SetLimits(perIP, perUser SessionLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.perIP = perIP
+	l.perUser = perUser
+}
+
+// Limits returns the limits of each source IP and each user.
+func (l *SessionLimiter) Limits() (perIP, perUser SessionLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.perIP, l.perUser
+}
+
+// acquireIP counts a new session from ip, returning the function ending it.
+func (l *SessionLimiter) acquireIP(ip string) (release func(), err error) {
+	return l.acquire(false, ip)
+}
+
+// acquireUser counts a new session of user, returning the function ending it.
+func (l *SessionLimiter) acquireUser(user string) (release func(), err error) {
+	return l.acquire(true, user)
+}
+
+func (l *SessionLimiter) acquire(byUser bool, key string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > sessionLimitSweep {
+		l.sweep(now)
+	}
+
+	counts, lim := l.ips, l.perIP
+	sessionsReason, rateReason := LimitIPSessions, LimitIPRate
+	if byUser {
+		counts, lim = l.users, l.perUser
+		sessionsReason, rateReason = LimitUserSessions, LimitUserRate
+	}
+	c := counts[key]
+	if c == nil {
+		c = &sessionCount{}
+		counts[key] = c
+	}
+	if lim.MaxSessions > 0 && c.active >= lim.MaxSessions {
+		return nil, &LimitError{Reason: sessionsReason}
+	}
+	if !c.allow(lim, now) {
+		return nil, &LimitError{Reason: rateReason}
+	}
+	c.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			c.active--
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// sweep drops the entries without sessions whose rate has recovered.
+func (l *SessionLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	sweepCounts(l.ips, l.perIP, now)
+	sweepCounts(l.users, l.perUser, now)
+}
+
+func sweepCounts(counts map[string]*sessionCount, lim SessionLimit, now time.Time) {
+	for key, c := range counts {
+		if c.active == 0 && c.full(lim, now) {
+			delete(counts, key)
+		}
+	}
+}
+
+// sessionCount counts the sessions of a source IP or a user.
+// New sessions take tokens from a bucket refilled at the rate of the limit.
+type sessionCount struct {
+	active int
+	tokens float64
+	last   time.Time
+}
+
+func (c *sessionCount) allow(lim SessionLimit, now time.Time) bool {
+	if lim.Rate <= 0 {
+		return true
+	}
+	burst := lim.burst()
+	if c.last.IsZero() {
+		c.tokens = burst
+	} else {
+		c.tokens += now.Sub(c.last).Seconds() * lim.Rate
+		if c.tokens > burst {
+			c.tokens = burst
+		}
+	}
+	c.last = now
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+func (c *sessionCount) full(lim SessionLimit, now time.Time) bool {
+	if lim.Rate <= 0 || c.last.IsZero() {
+		return true
+	}
+	return c.tokens+now.Sub(c.last).Seconds()*lim.Rate >= lim.burst()
+}
+
+func (lim SessionLimit) burst() float64 {
+	if lim.Burst < 1 {
+		return 1
+	}
+	return float64(lim.Burst)
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+const (
+	udpBufferSize = 64*1024 + 262
+)
+
+// udpAssociation relays the datagrams of one UDP ASSOCIATE request.
+type udpAssociation struct {
+	relay    *net.UDPConn // receives from and sends to the client
+	peer4    *net.UDPConn // receives from and sends to the IPv4 destinations
+	peer6    *net.UDPConn // receives from and sends to the IPv6 destinations, may be peer4
+	clientIP net.IP
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+
+	up, down int64 // payload bytes relayed from and to the client
+
+	upPace, downPace *pacer        // pace each direction, nil for no limit
+	done             chan struct{} // closed when the association ends
+}
+
+func (h *serverHandler) handleUDP(ctx context.Context, conn net.Conn, req *gosocks5.Request) error {
+	sess := sessionOf(ctx)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: addrIP(conn.LocalAddr())})
+	if err != nil {
+		return sess.replyError(conn, err)
+	}
+	defer relay.Close()
+
+	// The egress only gives the source addresses: datagrams always go direct.
+	egress, _ := h.dialer.(*Egress)
+	if h.router != nil {
+		egress = h.router.Route(sess.User, sess.RemoteAddr, nil)
+	}
+	if egress == nil {
+		egress = DirectEgress
+	}
+	peer4, peer6, err := egress.listenUDP(ctx)
+	if err != nil {
+		return sess.replyError(conn, err)
+	}
+	defer peer4.Close()
+	defer peer6.Close()
+
+	assoc := &udpAssociation{
+		relay:    relay,
+		peer4:    peer4,
+		peer6:    peer6,
+		clientIP: addrIP(conn.RemoteAddr()),
+		done:     make(chan struct{}),
+	}
+	assoc.upPace, assoc.downPace = sess.pacers()
+	// DST.ADDR and DST.PORT are where the client will send from, if it knows.
+	if ip := net.ParseIP(req.Addr.Host); ip != nil && !ip.IsUnspecified() && req.Addr.Port != 0 {
+		assoc.client = &net.UDPAddr{IP: ip, Port: int(req.Addr.Port)}
+	}
+
+	if err := sess.reply(conn, gosocks5.Succeeded, toSocksAddr(relay.LocalAddr())); err != nil {
+		return err
+	}
+
+	// The association lasts as long as the TCP connection of the request,
+	// or until the session has lasted MaxSessionTime.
+	if opts := sess.opts; opts.MaxSessionTime > 0 && !sess.Start.IsZero() {
+		conn.SetReadDeadline(sess.Start.Add(opts.MaxSessionTime))
+	}
+	errc := make(chan error, 4)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, conn)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = errSessionTimeout
+		}
+		errc <- err
+	}()
+	go func() {
+		errc <- h.relayToPeers(ctx, assoc)
+	}()
+	go func() {
+		errc <- assoc.relayToClient(peer4)
+	}()
+	if peer6 != peer4 {
+		go func() {
+			errc <- assoc.relayToClient(peer6)
+		}()
+	}
+
+	start := time.Now()
+	err = <-errc
+	close(assoc.done)
+	relay.Close()
+	peer4.Close()
+	peer6.Close()
+
+	stats := &RelayStats{
+		Up:       atomic.LoadInt64(&assoc.up),
+		Down:     atomic.LoadInt64(&assoc.down),
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	sess.onRelayDone(stats)
+	return err
+}
+
+// relayToPeers forwards the datagrams of the client to their destinations,
+// dropping those the policies do not allow.
+func (h *serverHandler) relayToPeers(ctx context.Context, assoc *udpAssociation) error {
+	sess := sessionOf(ctx)
+	b := make([]byte, udpBufferSize)
+	for {
+		n, raddr, err := assoc.relay.ReadFromUDP(b)
+		if err != nil {
+			return err
+		}
+		if !assoc.fromClient(raddr) {
+			continue
+		}
+
+		dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(b[:n]))
+		if err != nil || dgram.Header.Frag != 0 { // fragmentation is not supported
+			continue
+		}
+		if !h.allowed(sess, &gosocks5.Request{Cmd: gosocks5.CmdUdp, Addr: dgram.Header.Addr}) {
+			continue
+		}
+		addr, err := h.resolveUDP(ctx, dgram.Header.Addr)
+		if err != nil {
+			continue
+		}
+		peer := assoc.peer4
+		if addr.IP.To4() == nil {
+			peer = assoc.peer6
+		}
+		if _, err := peer.WriteToUDP(dgram.Data, addr); err == nil {
+			atomic.AddInt64(&assoc.up, int64(len(dgram.Data)))
+			if assoc.upPace != nil {
+				assoc.upPace.wait(int64(len(dgram.Data)), assoc.done)
+			}
+		}
+	}
+}
+
+// relayToClient forwards the datagrams from the destinations received by peer to the client.
+func (assoc *udpAssociation) relayToClient(peer *net.UDPConn) error {
+	b := make([]byte, udpBufferSize)
+	var buf bytes.Buffer
+	for {
+		n, raddr, err := peer.ReadFromUDP(b)
+		if err != nil {
+			return err
+		}
+
+		assoc.mu.Lock()
+		client := assoc.client
+		assoc.mu.Unlock()
+		if client == nil {
+			continue
+		}
+
+		buf.Reset()
+		header := gosocks5.NewUDPHeader(0, 0, toSocksAddr(raddr))
+		if err := gosocks5.NewUDPDatagram(header, b[:n]).Write(&buf); err != nil {
+			continue
+		}
+		if _, err := assoc.relay.WriteToUDP(buf.Bytes(), client); err == nil {
+			atomic.AddInt64(&assoc.down, int64(n))
+			if assoc.downPace != nil {
+				assoc.downPace.wait(int64(n), assoc.done)
+			}
+		}
+	}
+}
+
+// fromClient reports whether a datagram from addr comes from the client.
+// The first datagram from the address of the client's TCP connection
+// fixes the client's UDP address if the request did not give it.
+func (assoc *udpAssociation) fromClient(addr *net.UDPAddr) bool {
+	assoc.mu.Lock()
+	defer assoc.mu.Unlock()
+
+	if assoc.client == nil {
+		if assoc.clientIP != nil && !assoc.clientIP.Equal(addr.IP) {
+			return false
+		}
+		assoc.client = addr
+		return true
+	}
+	return assoc.client.IP.Equal(addr.IP) && assoc.client.Port == addr.Port
+}
+
+func (h *serverHandler) resolveUDP(ctx context.Context, addr *gosocks5.Addr) (*net.UDPAddr, error) {
+	if ip := net.ParseIP(addr.Host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: int(addr.Port)}, nil
+	}
+
+	ips, err := h.lookup(ctx, addr.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: int(addr.Port)}, nil
+}
@@ -488,12 +488,14 @@ func NewReply(rep uint8, addr *Addr) *Reply {
 	}
 }
 
+// ReadReply reads a reply from r, reading no further than its end:
+// the data the server relays right after it is left in r.
 func ReadReply(r io.Reader) (*Reply, error) {
 	// b := make([]byte, 262)
 	b := sPool.Get().([]byte)
 	defer sPool.Put(b)
 
-	n, err := io.ReadAtLeast(r, b, 5)
+	n, err := io.ReadFull(r, b[:5])
 	if err != nil {
 		return nil, err
 	}